@@ -0,0 +1,107 @@
+package kd6rmx
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SupportedBaudRates are the communication speeds supported by the sensor,
+// slowest first.
+var SupportedBaudRates = []int{9600, 19200, 115200}
+
+// probeTimeout is how long to wait for a reply at each speed when probing,
+// if the sensor does not have a Timeout.
+const probeTimeout = 500 * time.Millisecond
+
+// ProbeBaudRate finds the communication speed used by the sensor on the
+// serial port at port, which must be a device path as for OpenSerial.
+func ProbeBaudRate(port string) (int, error) {
+	t, err := OpenSerial(port, DefaultSerialConfig)
+	if err != nil {
+		return 0, err
+	}
+	defer t.Close()
+
+	return Sensor{Transport: t}.ProbeBaudRate()
+}
+
+// ProbeBaudRate finds the communication speed used by the sensor, by trying
+// each of SupportedBaudRates on the host side with a harmless BR read-back.
+// The sensor's Transport must be a BaudRateSetter, and is left at the speed
+// that works.
+func (cis Sensor) ProbeBaudRate() (int, error) {
+	bs, ok := cis.Transport.(BaudRateSetter)
+	if !ok {
+		return 0, errors.New("transport cannot change the host baud rate")
+	}
+	if cis.Timeout == 0 {
+		cis.Timeout = probeTimeout
+	}
+
+	for _, baud := range SupportedBaudRates {
+		if err := bs.SetBaudRate(baud); err != nil {
+			return 0, err
+		}
+		markStale(cis.Transport)
+		got, err := cis.ReadCommunicationSpeed()
+		if err != nil {
+			if ctxErr := cis.context().Err(); ctxErr != nil {
+				return 0, ctxErr
+			}
+			continue
+		}
+		if got == baud {
+			return baud, nil
+		}
+	}
+	return 0, errors.New("no reply from sensor at any supported baud rate")
+}
+
+// SwitchBaudRate changes the communication speed of both the sensor and the
+// host side of the connection, and checks that the sensor replies at the new
+// speed. If it does not, the speed the sensor is using is probed, so that the
+// connection is left working. No other commands are sent on the connection
+// while switching.
+//
+// The connection's Transport must be a BaudRateSetter, such as a
+// SerialTransport.
+func (c *Conn) SwitchBaudRate(baud int) error {
+	if _, ok := c.Transport.(BaudRateSetter); !ok {
+		return errors.New("transport cannot change the host baud rate")
+	}
+
+	return c.Do(func(cis Sensor) error {
+		current, err := cis.ReadCommunicationSpeed()
+		if err != nil {
+			return err
+		}
+		if current == baud {
+			return nil
+		}
+
+		err = cis.CommunicationSpeed(baud)
+		if err == nil {
+			var got int
+			got, err = cis.ReadCommunicationSpeed()
+			if err == nil && got == baud {
+				return nil
+			}
+		}
+
+		// find out which speed the sensor ended up at
+		if _, perr := cis.ProbeBaudRate(); perr != nil {
+			return fmt.Errorf("switching to %d baud failed, and the sensor was lost: %v", baud, perr)
+		}
+		if err == nil {
+			err = errors.New("sensor did not change speed")
+		}
+		return fmt.Errorf("switching to %d baud failed: %v", baud, err)
+	})
+}
+
+// SwitchToFastestBaudRate switches the connection to the fastest of
+// SupportedBaudRates, see SwitchBaudRate.
+func (c *Conn) SwitchToFastestBaudRate() error {
+	return c.SwitchBaudRate(SupportedBaudRates[len(SupportedBaudRates)-1])
+}
@@ -0,0 +1,232 @@
+package kd6rmx
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CalibrationStep is a step of Calibrate that needs the operator to get the
+// sensor ready.
+type CalibrationStep int
+
+const (
+	// CalibrateDark is the dark correction. The sensor must be covered, so
+	// that no light reaches it. Calibrate turns the LEDs off.
+	CalibrateDark CalibrationStep = iota
+
+	// CalibrateWhite is the white correction. The white reference must be in
+	// place in front of the sensor. Calibrate turns the LEDs on.
+	CalibrateWhite
+)
+
+func (s CalibrationStep) String() string {
+	switch s {
+	case CalibrateDark:
+		return "dark"
+	case CalibrateWhite:
+		return "white"
+	}
+	return fmt.Sprintf("CalibrationStep(%d)", int(s))
+}
+
+// Calibration configures Calibrate.
+type Calibration struct {
+	// Prepare is called before each step, to have the operator or the
+	// machine get the sensor ready for it. Calibrate stops if it returns an
+	// error. If nil, the sensor is assumed to be ready.
+	Prepare func(step CalibrationStep) error
+
+	// LEDs are the LEDs to turn on for the white correction, "A", "B" or
+	// "AB". If empty, the LEDs that are on when Calibrate starts are used,
+	// or both if none are.
+	LEDs string
+
+	// WhiteTarget is the target level of the white correction, 1-255, which
+	// the correction is performed with. If zero, the sensor's current target
+	// is used.
+	WhiteTarget int
+
+	// Preset is the user preset to save the result to. If zero, the result
+	// is not saved.
+	Preset int
+}
+
+// busyPollInterval is how often to ask a busy sensor if it is done.
+const busyPollInterval = 100 * time.Millisecond
+
+// Calibrate performs the dark and the white correction and turns both
+// corrections on, calling c.Prepare before each. Every setting it changes is
+// read back to check that the sensor took it. If c.Preset is set, the
+// result is then saved to that user preset, and checked by loading the
+// preset again and reading it back.
+//
+// If Calibrate fails, the sensor is left as it was at the failing step.
+func (cis Sensor) Calibrate(c Calibration) error {
+	if c.Preset != 0 && !isUserPreset(c.Preset) {
+		return fmt.Errorf("invalid preset %d", c.Preset)
+	}
+	if c.WhiteTarget < 0 || c.WhiteTarget > 255 {
+		return errors.New("invalid white correction target")
+	}
+
+	leds, pulse, err := cis.ReadLEDControl()
+	if err != nil {
+		return err
+	}
+	if c.LEDs != "" {
+		leds = strings.ToUpper(c.LEDs)
+	}
+	if leds == "" {
+		leds = "AB"
+	}
+
+	if err := cis.calibrateDark(c, pulse); err != nil {
+		return fmt.Errorf("dark correction: %w", err)
+	}
+	if err := cis.calibrateWhite(c, leds, pulse); err != nil {
+		return fmt.Errorf("white correction: %w", err)
+	}
+
+	if c.Preset == 0 {
+		return nil
+	}
+	if err := cis.SaveSettings(c.Preset); err != nil {
+		return err
+	}
+	active, err := cis.ReadSettings()
+	if err != nil {
+		return err
+	}
+	// loading the preset that was just saved leaves the sensor as it is, so
+	// unlike ReadPreset there is nothing to bring back afterwards.
+	saved, err := cis.readPreset(c.Preset)
+	if err != nil {
+		return err
+	}
+	if saved != active {
+		return fmt.Errorf("preset %d reads back different settings than were saved", c.Preset)
+	}
+	return nil
+}
+
+func (cis Sensor) calibrateDark(c Calibration, pulse int) error {
+	if c.Prepare != nil {
+		if err := c.Prepare(CalibrateDark); err != nil {
+			return err
+		}
+	}
+
+	if err := cis.LEDControl("", false, pulse); err != nil {
+		return err
+	}
+	if err := cis.verifyLEDs(""); err != nil {
+		return err
+	}
+
+	if err := cis.PerformDarkCorrection(); err != nil {
+		return err
+	}
+	err := cis.whenReady(func() error { return cis.DarkCorrectionEnabled(true) })
+	if err != nil {
+		return err
+	}
+	return cis.verifySwitch("dark correction", cis.ReadDarkCorrectionEnabled)
+}
+
+func (cis Sensor) calibrateWhite(c Calibration, leds string, pulse int) error {
+	if c.Prepare != nil {
+		if err := c.Prepare(CalibrateWhite); err != nil {
+			return err
+		}
+	}
+
+	if err := cis.LEDControl(leds, true, pulse); err != nil {
+		return err
+	}
+	if err := cis.verifyLEDs(leds); err != nil {
+		return err
+	}
+
+	// setting the target performs the correction with it, so only perform
+	// it separately when keeping the current target.
+	if c.WhiteTarget == 0 {
+		if err := cis.PerformWhiteCorrection(); err != nil {
+			return err
+		}
+	} else {
+		if err := cis.WhiteCorrectionTarget(c.WhiteTarget); err != nil {
+			return err
+		}
+		var target int
+		err := cis.whenReady(func() (err error) {
+			target, err = cis.ReadWhiteCorrectionTarget()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if target != c.WhiteTarget {
+			return fmt.Errorf("target reads back %d, want %d", target, c.WhiteTarget)
+		}
+	}
+
+	err := cis.whenReady(func() error { return cis.WhiteCorrectionEnabled(true) })
+	if err != nil {
+		return err
+	}
+	return cis.verifySwitch("white correction", cis.ReadWhiteCorrectionEnabled)
+}
+
+// verifyLEDs checks that the LEDs that are on are leds.
+func (cis Sensor) verifyLEDs(leds string) error {
+	var got string
+	err := cis.whenReady(func() (err error) {
+		got, _, err = cis.ReadLEDControl()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if got != leds {
+		return fmt.Errorf("LEDs read back %q, want %q", got, leds)
+	}
+	return nil
+}
+
+// verifySwitch checks that read returns that the switch called name is on.
+func (cis Sensor) verifySwitch(name string, read func() (bool, error)) error {
+	var on bool
+	err := cis.whenReady(func() (err error) {
+		on, err = read()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !on {
+		return fmt.Errorf("%s reads back off", name)
+	}
+	return nil
+}
+
+// whenReady calls fn until the sensor is no longer busy, such as after
+// starting a correction, for at most the sensor's Timeout.
+func (cis Sensor) whenReady(fn func() error) error {
+	timeout := cis.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := fn()
+		if !errors.Is(err, ErrBusy) || time.Now().After(deadline) {
+			return err
+		}
+		if err := sleep(cis.context(), busyPollInterval); err != nil {
+			return err
+		}
+	}
+}
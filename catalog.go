@@ -0,0 +1,213 @@
+package kd6rmx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Recipe is a named set of settings kept on the host, for example the
+// settings for one product, which can be pushed to a preset of a sensor.
+type Recipe struct {
+	Name        string   `json:"-" yaml:"-" toml:"-"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty" toml:"description,omitempty"`
+	Settings    Settings `json:"settings" yaml:"settings" toml:"settings"`
+}
+
+// Catalog is a directory of recipes, with one file per recipe named after
+// the recipe, in any of the formats of settings files. Recipe files hold
+// all of the settings, as written by Put.
+type Catalog struct {
+	Dir string
+}
+
+// recipeExts are the extensions of recipe files, in order of preference.
+var recipeExts = []string{".yaml", ".yml", ".json", ".toml"}
+
+// List returns all of the recipes in the catalog, sorted by name.
+func (c Catalog) List() ([]Recipe, error) {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var recipes []Recipe
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		if e.IsDir() || !isRecipeExt(filepath.Ext(e.Name())) || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		r, err := c.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		recipes = append(recipes, r)
+	}
+
+	sort.Slice(recipes, func(i, j int) bool { return recipes[i].Name < recipes[j].Name })
+	return recipes, nil
+}
+
+// Get returns the recipe with the name. Recipe files that leave out any of
+// the settings are rejected, rather than pushing zero for them.
+func (c Catalog) Get(name string) (Recipe, error) {
+	path, err := c.find(name)
+	if err != nil {
+		return Recipe{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Recipe{}, err
+	}
+
+	r := Recipe{Name: name}
+	if err := decode(data, filepath.Ext(path), &r); err != nil {
+		return Recipe{}, fmt.Errorf("recipe %s: %v", name, err)
+	}
+
+	// settings missing from the file would be pushed as zero, so decode it
+	// again on top of other values to find any that are missing.
+	m := Recipe{Settings: missingSettings}
+	if err := decode(data, filepath.Ext(path), &m); err != nil {
+		return Recipe{}, fmt.Errorf("recipe %s: %v", name, err)
+	}
+	if missing := DiffSettings(r.Settings, m.Settings); len(missing) > 0 {
+		fields := make([]string, len(missing))
+		for i, c := range missing {
+			fields[i] = c.Field
+		}
+		return Recipe{}, fmt.Errorf("recipe %s: missing settings %s", name, strings.Join(fields, ", "))
+	}
+	return r, nil
+}
+
+// missingSettings has a value other than zero for every setting, to find the
+// settings missing from a recipe file.
+var missingSettings = Settings{
+	CommunicationSpeed:    -1,
+	OutputFrequency:       -1,
+	OutputFormat:          OutputFormat{Number: -1},
+	PixelOverlap:          true,
+	PixelInterpolation:    true,
+	PixelResolution:       -1,
+	ExternalSync:          true,
+	InternalSyncClock:     -1,
+	LEDs:                  "-",
+	LEDPulseDivider:       -1,
+	LEDDutyA:              -1,
+	LEDDutyB:              -1,
+	LEDIlluminationPeriod: -1,
+	DarkCorrection:        true,
+	WhiteCorrection:       true,
+	WhiteCorrectionTarget: -1,
+	GainAmplifierEnabled:  true,
+	GainAmplifierLevel:    -1,
+	TestPatternEnabled:    true,
+	TestPattern:           -1,
+}
+
+// Put adds the recipe to the catalog, replacing any recipe with the same
+// name. New recipes are written as YAML.
+func (c Catalog) Put(r Recipe) error {
+	if err := checkRecipeName(r.Name); err != nil {
+		return err
+	}
+
+	path, err := c.find(r.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		path = filepath.Join(c.Dir, r.Name+".yaml")
+	} else if err != nil {
+		return err
+	}
+
+	data, err := encode(r, filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// find returns the path of the file of the recipe with the name.
+func (c Catalog) find(name string) (string, error) {
+	if err := checkRecipeName(name); err != nil {
+		return "", err
+	}
+	for _, ext := range recipeExts {
+		path := filepath.Join(c.Dir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("recipe %s: %w", name, os.ErrNotExist)
+}
+
+func checkRecipeName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid recipe name %q", name)
+	}
+	return nil
+}
+
+func isRecipeExt(ext string) bool {
+	for _, e := range recipeExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// PushRecipe writes the settings of the recipe to user preset n, keeping
+// the sensor's active settings. Use LoadSettings to make it active. The
+// preset is saved with the sensor's current white correction target and
+// correction data, as for RestorePresets.
+func (cis Sensor) PushRecipe(r Recipe, n int) error {
+	return cis.RestorePresets(PresetBackup{Presets: []PresetSettings{{Preset: n, Settings: r.Settings}}})
+}
+
+// ReadPreset reads the settings stored in preset n, by loading it and
+// reading back the settings. The active settings of the sensor are brought
+// back afterwards as for BackupPresets: if they are not those of preset n,
+// the other user presets are read as well, to find the one they were loaded
+// from and load it again.
+func (cis Sensor) ReadPreset(n int) (Settings, error) {
+	if n != 0 && !isUserPreset(n) {
+		return Settings{}, fmt.Errorf("invalid preset %d", n)
+	}
+
+	active, err := cis.ReadSettings()
+	if err != nil {
+		return Settings{}, err
+	}
+	s, err := cis.readPreset(n)
+	if err != nil {
+		return Settings{}, cis.reloadActive(active, nil, fmt.Errorf("reading preset %d: %w", n, err))
+	}
+
+	read := []PresetSettings{{Preset: n, Settings: s}}
+	found := s == active
+	for _, m := range UserPresets {
+		if found || m == n {
+			continue
+		}
+		ms, err := cis.readPreset(m)
+		if err != nil {
+			return Settings{}, cis.reloadActive(active, read, fmt.Errorf("reading preset %d: %w", m, err))
+		}
+		read = append(read, PresetSettings{Preset: m, Settings: ms})
+		found = ms == active
+	}
+	return s, cis.reloadActive(active, read, nil)
+}
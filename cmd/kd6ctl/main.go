@@ -3,13 +3,22 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/northvolt/go-kd6rmx"
+	"github.com/northvolt/go-kd6rmx/remote"
 	"github.com/peterbourgon/ff/v3/ffcli"
 )
 
@@ -17,10 +26,44 @@ func main() {
 	var (
 		rootFlagSet = flag.NewFlagSet("kd6ctl", flag.ExitOnError)
 		port        = rootFlagSet.String("p", "/dev/corser/XtiumCLMX41_s0", "port of KD6RMX sensor to use")
-		logging     = rootFlagSet.Bool("log", false, "turn on debug logging")
-		logFile     = rootFlagSet.Bool("log-file", true, "turn on logging to file")
+		logging     = rootFlagSet.Bool("log", false, "turn on debug logging to stderr")
+		logFile     = rootFlagSet.Bool("log-file", false, "deprecated: append debug logging to kd6cmd.log, use -log-path instead")
+		logPath     = rootFlagSet.String("log-path", "", "append debug logging to this file")
+		timeout     = rootFlagSet.Duration("timeout", 10*time.Second, "how long to wait for each reply from the sensor")
+		record      = rootFlagSet.String("record", "", "append a transcript of all commands to this file, which can be replayed with -p replay://<file>")
+		remoteURL   = rootFlagSet.String("remote", "", "URL of a sensor served by kd6d to use instead of -p, for example http://host:8080/sensors/line1")
+		modelFlag   = rootFlagSet.String("model", "", "product number of the model of CIS in hex, or 'detect' to read it from CIS, to reject settings it cannot do")
 	)
 
+	var (
+		logger   kd6rmx.Logger
+		observer kd6rmx.Observer
+		cisModel *kd6rmx.Model
+	)
+
+	// transport is opened on first use, and kept open until kd6ctl exits, so
+	// that all commands of a subcommand go through the same connection. This
+	// keeps a replayed transcript in order.
+	var transport kd6rmx.Transport
+
+	newSensor := func(ctx context.Context) kd6rmx.Sensor {
+		cis := kd6rmx.Sensor{Port: *port, Logger: logger, Observer: observer, Timeout: *timeout, Model: cisModel}
+		if *remoteURL != "" {
+			cis.Port = *remoteURL
+			cis.Transport = remote.NewTransport(*remoteURL)
+			return cis.WithContext(ctx)
+		}
+
+		if transport == nil {
+			// if the port cannot be opened, the first command reports why
+			if t, err := kd6rmx.Dial(*port); err == nil {
+				transport = t
+			}
+		}
+		cis.Transport = transport
+		return cis.WithContext(ctx)
+	}
+
 	version := &ffcli.Command{
 		Name:       "version",
 		ShortUsage: "kd6ctl version",
@@ -35,7 +78,7 @@ func main() {
 		Name:       "load",
 		ShortUsage: "kd6ctl load <preset>",
 		ShortHelp:  "Load user settings.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if n := len(args); n != 1 {
 				return fmt.Errorf("load requires the number of the preset you want ot load")
 			}
@@ -45,7 +88,7 @@ func main() {
 				return err
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			return cis.LoadSettings(preset)
 		},
 	}
@@ -54,12 +97,12 @@ func main() {
 		Name:       "pattern",
 		ShortUsage: "kd6ctl pattern <value/on/off>",
 		ShortHelp:  "Decide test pattern.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if len(args) < 1 {
 				return fmt.Errorf("needs test pattern value")
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			switch args[0] {
 			case "on":
 				cis.TestPatternEnabled(true)
@@ -81,7 +124,7 @@ func main() {
 		Name:       "save",
 		ShortUsage: "kd6ctl save <preset>",
 		ShortHelp:  "Save current settings into a user preset.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if n := len(args); n != 1 {
 				return fmt.Errorf("load requires the number of the preset you want ot load")
 			}
@@ -91,16 +134,63 @@ func main() {
 				return err
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			return cis.SaveSettings(preset)
 		},
 	}
 
+	baud := &ffcli.Command{
+		Name:       "baud",
+		ShortUsage: "kd6ctl baud [probe/fastest/<rate>]",
+		ShortHelp:  "Show, probe or change the communication speed.",
+		Exec: func(ctx context.Context, args []string) error {
+			conn, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			if len(args) < 1 {
+				rate, err := conn.ReadCommunicationSpeed()
+				if err != nil {
+					return err
+				}
+				fmt.Println(rate)
+				return nil
+			}
+
+			switch args[0] {
+			case "probe":
+				rate, err := conn.ProbeBaudRate()
+				if err != nil {
+					return err
+				}
+				fmt.Println(rate)
+				return nil
+			case "fastest":
+				return conn.SwitchToFastestBaudRate()
+			}
+
+			rate, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			if _, ok := conn.Transport.(kd6rmx.BaudRateSetter); !ok {
+				if *remoteURL != "" {
+					// kd6d switches its side of the connection itself
+					return conn.CommunicationSpeed(rate)
+				}
+				fmt.Fprintf(os.Stderr, "the host side of %s must be changed to %d baud separately\n", *port, rate)
+				return conn.CommunicationSpeed(rate)
+			}
+			return conn.SwitchBaudRate(rate)
+		},
+	}
+
 	outputfreq := &ffcli.Command{
 		Name:       "frequency",
 		ShortUsage: "kd6ctl frequency <freq>",
 		ShortHelp:  "Change output frequency (in Mhz).",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if n := len(args); n != 1 {
 				return fmt.Errorf("outputfreq requires providing the desired frequency")
 			}
@@ -110,7 +200,7 @@ func main() {
 				return err
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			return cis.OutputFrequency(float32(freq))
 		},
 	}
@@ -119,7 +209,7 @@ func main() {
 		Name:       "format",
 		ShortUsage: "kd6ctl format <bits> <interface> <config> <num>",
 		ShortHelp:  "Change output format.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if n := len(args); n != 4 {
 				return fmt.Errorf("outputfmt requires providing all the needed params")
 			}
@@ -159,7 +249,7 @@ func main() {
 				return err
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			return cis.PixelOutputFormat(bits, intf, conf, num)
 		},
 	}
@@ -168,7 +258,7 @@ func main() {
 		Name:       "interpolation",
 		ShortUsage: "kd6ctl interpolation <on/off>",
 		ShortHelp:  "Set interpolation on/off.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if n := len(args); n != 1 {
 				return fmt.Errorf("interp nust be either 'on' or 'off'")
 			}
@@ -183,7 +273,7 @@ func main() {
 				return fmt.Errorf("invalid interpolation, must be on or off")
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			return cis.PixelInterpolation(on)
 		},
 	}
@@ -192,12 +282,12 @@ func main() {
 		Name:       "dark",
 		ShortUsage: "kd6ctl dark <on/off/adjust>",
 		ShortHelp:  "Dark correction on/off/adjust.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if n := len(args); n < 1 {
 				return fmt.Errorf("dark correction requires a subcommand: 'on', 'off', or 'adjust'")
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 
 			switch args[0] {
 			case "on":
@@ -216,12 +306,12 @@ func main() {
 		Name:       "white",
 		ShortUsage: "kd6ctl white <on/off/adjust/target>",
 		ShortHelp:  "White correction on/off/adjust/target.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if n := len(args); n < 1 {
 				return fmt.Errorf("white correction requires a subcommand: 'on', 'off', 'adjust', or 'target'")
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 
 			switch args[0] {
 			case "on":
@@ -253,7 +343,7 @@ func main() {
 		Name:       "led",
 		ShortUsage: "kd6ctl led <A/B/AB> <on/off> [pulse]",
 		ShortHelp:  "Turn sensor LEDs on or off.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if len(args) < 2 {
 				return fmt.Errorf("led command requires specific LEDs either 'a', 'b', 'ab'. You must also specify to set LEDs 'on' or 'off'")
 			}
@@ -284,7 +374,7 @@ func main() {
 				}
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			return cis.LEDControl(leds, on, pulse)
 		},
 	}
@@ -293,7 +383,7 @@ func main() {
 		Name:       "duty",
 		ShortUsage: "kd6ctl duty <a/b> <duty>",
 		ShortHelp:  "Set LED duty illumination period register value. Valid range 0 to 4095.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if len(args) < 2 {
 				return fmt.Errorf("duty command requires specific LEDs either 'a' or 'b'. You must also specify the duty to set LEDs to")
 			}
@@ -308,7 +398,7 @@ func main() {
 				return err
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			return cis.LEDDutyCycle(led, duty)
 		},
 	}
@@ -317,7 +407,7 @@ func main() {
 		Name:       "illum",
 		ShortUsage: "kd6ctl illum <period>",
 		ShortHelp:  "Set effective LED illumination period register value. Valid range 0 to 4095.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if len(args) < 1 {
 				return fmt.Errorf("adjust the effective illumination period number")
 			}
@@ -327,7 +417,7 @@ func main() {
 				return err
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			return cis.LEDIlluminationPeriod(period)
 		},
 	}
@@ -336,12 +426,12 @@ func main() {
 		Name:       "gain",
 		ShortUsage: "kd6ctl gain <value/on/off>",
 		ShortHelp:  "Enables the gain control and sets the specified value ",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if len(args) < 1 {
 				return fmt.Errorf("adjust the gain number")
 			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
+			cis := newSensor(ctx)
 			switch args[0] {
 			case "on":
 				cis.GainAmplifierEnabled(true)
@@ -359,35 +449,436 @@ func main() {
 		},
 	}
 
+	discoverFlagSet := flag.NewFlagSet("kd6ctl discover", flag.ExitOnError)
+	var bridges stringsFlag
+	discoverFlagSet.Var(&bridges, "bridge", "also probe this serial-to-Ethernet converter, for example tcp://10.0.0.5:4001 (can be repeated)")
+	discoverJSON := discoverFlagSet.Bool("json", false, "print as JSON")
+
+	discover := &ffcli.Command{
+		Name:       "discover",
+		ShortUsage: "kd6ctl discover [-json] [-bridge <url>...]",
+		ShortHelp:  "List the ports with CIS attached.",
+		FlagSet:    discoverFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			ports := append(kd6rmx.DiscoverPorts(), bridges...)
+			found := kd6rmx.Discover(ctx, ports)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if *discoverJSON {
+				if found == nil {
+					found = []kd6rmx.DiscoveredSensor{}
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(found)
+			}
+
+			if len(found) == 0 {
+				return fmt.Errorf("no sensors found on %d ports", len(ports))
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "PORT\tSERIAL NUMBER\tPRODUCT\tBAUD\n")
+			for _, d := range found {
+				fmt.Fprintf(w, "%s\t%s\t%04X\t%d\n", d.Port, d.Info.SerialNumber, d.Info.ProductNumber, d.BaudRate)
+			}
+			return w.Flush()
+		},
+	}
+
+	identityFlagSet := flag.NewFlagSet("kd6ctl identity", flag.ExitOnError)
+	identityJSON := identityFlagSet.Bool("json", false, "print as JSON")
+
+	identity := &ffcli.Command{
+		Name:       "identity",
+		ShortUsage: "kd6ctl identity [-json]",
+		ShortHelp:  "Show the product number, serial number and manufacturing date of CIS.",
+		FlagSet:    identityFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			info, err := newSensor(ctx).Identity()
+			if err != nil {
+				return err
+			}
+
+			if *identityJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(info)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "Product number:\t%04X\n", info.ProductNumber)
+			fmt.Fprintf(w, "Serial number:\t%s\n", info.SerialNumber)
+			fmt.Fprintf(w, "Manufactured:\t%04d-%02d\n", info.Year, info.Month)
+			return w.Flush()
+		},
+	}
+
+	model := &ffcli.Command{
+		Name:       "model",
+		ShortUsage: "kd6ctl model",
+		ShortHelp:  "Show the model of CIS and what it supports.",
+		Exec: func(ctx context.Context, args []string) error {
+			if cisModel != nil {
+				return printModel(*cisModel)
+			}
+			m, err := newSensor(ctx).DetectModel()
+			if err != nil {
+				return err
+			}
+			return printModel(m)
+		},
+	}
+
 	dumpreg := &ffcli.Command{
 		Name:       "dumpreg",
 		ShortUsage: "kd6ctl dumpreg",
 		ShortHelp:  "Dump the register values of CIS.",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
+			conn, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			return dumpRegisters(conn.Sensor)
+		},
+	}
+
+	applyFlagSet := flag.NewFlagSet("kd6ctl apply", flag.ExitOnError)
+	applyFile := applyFlagSet.String("f", "", "settings file to apply (.json, .yaml, .yml or .toml)")
+	dryRun := applyFlagSet.Bool("dry-run", false, "only show the changes that would be applied")
+	applyTarget := applyFlagSet.Bool("white-target", false, "also set the white correction target, which performs a white correction")
+
+	apply := &ffcli.Command{
+		Name:       "apply",
+		ShortUsage: "kd6ctl apply [-dry-run] [-white-target] -f <file>",
+		ShortHelp:  "Apply the settings in a settings file.",
+		FlagSet:    applyFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			if *applyFile == "" {
+				return fmt.Errorf("apply requires a settings file")
+			}
+
+			cis, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			// start from the current settings, so the file only needs to
+			// contain the settings it wants to change.
+			current, err := cis.ReadSettings()
+			if err != nil {
+				return err
+			}
+			settings := current
+			if err := kd6rmx.ReadSettingsFile(*applyFile, &settings); err != nil {
+				return err
+			}
+			if !*applyTarget {
+				settings.WhiteCorrectionTarget = current.WhiteCorrectionTarget
+			}
+
+			var changes []kd6rmx.SettingChange
+			if *dryRun {
+				changes = kd6rmx.DiffSettings(current, settings)
+			} else {
+				changes, err = cis.UpdateSettings(settings)
+				if err == nil && settings.WhiteCorrectionTarget != current.WhiteCorrectionTarget {
+					err = cis.WhiteCorrectionTarget(settings.WhiteCorrectionTarget)
+					if err == nil {
+						changes = append(changes, kd6rmx.SettingChange{Field: "WhiteCorrectionTarget", Old: current.WhiteCorrectionTarget, New: settings.WhiteCorrectionTarget})
+					}
+				}
+			}
+			for _, c := range changes {
+				fmt.Println(c)
+			}
+			return err
+		},
+	}
+
+	exportFlagSet := flag.NewFlagSet("kd6ctl export", flag.ExitOnError)
+	exportFile := exportFlagSet.String("o", "", "settings file to write (.json, .yaml, .yml or .toml), or stdout if empty")
+	exportFormat := exportFlagSet.String("format", "yaml", "format to use when writing to stdout")
+
+	export := &ffcli.Command{
+		Name:       "export",
+		ShortUsage: "kd6ctl export [-o <file>]",
+		ShortHelp:  "Export the current settings to a settings file.",
+		FlagSet:    exportFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			cis, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			settings, err := cis.ReadSettings()
+			if err != nil {
+				return err
+			}
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
-			cis.ReadRegister("BR")
-			cis.ReadRegister("OF")
-			cis.ReadRegister("OC")
-			cis.ReadRegisterWithVal("OC", "C0")
-			cis.ReadRegister("RC")
-			cis.ReadRegister("SS")
-			cis.ReadRegister("DC")
-			cis.ReadRegister("LC")
-			cis.ReadRegisterWithVal("LC", "A0")
-			cis.ReadRegisterWithVal("LC", "C0")
-			cis.ReadRegisterWithVal("LC", "E0")
-			cis.ReadRegister("WC")
-			// cis.ReadRegister("PG")
-			// cis.ReadRegister("GC")
-			cis.ReadRegister("TP")
-			cis.ReadRegisterWithVal("TP", "A0")
-			cis.ReadRegisterWithVal("SI", "C0")
-
-			// PGA
-			cis.ReadRegisterWithVal("PG", "80")
-			cis.ReadRegisterWithVal("PG", "A0")
+			if *exportFile != "" {
+				return kd6rmx.WriteSettingsFile(*exportFile, settings)
+			}
+
+			data, err := kd6rmx.EncodeSettings(settings, *exportFormat)
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(data)
+			return err
+		},
+	}
+
+	backupFlagSet := flag.NewFlagSet("kd6ctl backup", flag.ExitOnError)
+	backupFile := backupFlagSet.String("o", "", "preset file to write (.json, .yaml, .yml or .toml)")
+
+	backup := &ffcli.Command{
+		Name:       "backup",
+		ShortUsage: "kd6ctl backup -o <file>",
+		ShortHelp:  "Back up the user presets to a file.",
+		FlagSet:    backupFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			if *backupFile == "" {
+				return fmt.Errorf("backup requires a preset file")
+			}
 
+			conn, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			b, err := conn.BackupPresets()
+			if err != nil {
+				return err
+			}
+			return kd6rmx.WritePresetFile(*backupFile, b)
+		},
+	}
+
+	restoreFlagSet := flag.NewFlagSet("kd6ctl restore", flag.ExitOnError)
+	restoreFile := restoreFlagSet.String("f", "", "preset file to restore (.json, .yaml, .yml or .toml)")
+
+	restore := &ffcli.Command{
+		Name:       "restore",
+		ShortUsage: "kd6ctl restore -f <file>",
+		ShortHelp:  "Restore the user presets from a file.",
+		FlagSet:    restoreFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			if *restoreFile == "" {
+				return fmt.Errorf("restore requires a preset file")
+			}
+
+			b, err := kd6rmx.ReadPresetFile(*restoreFile)
+			if err != nil {
+				return err
+			}
+
+			conn, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			info, err := conn.Identity()
+			if err != nil {
+				return err
+			}
+			if info.SerialNumber != b.Sensor.SerialNumber {
+				fmt.Printf("restoring presets of sensor %s onto sensor %s\n", b.Sensor.SerialNumber, info.SerialNumber)
+			}
+			return conn.RestorePresets(b)
+		},
+	}
+
+	catalogDir := "kd6ctl-presets"
+	if dir, err := os.UserConfigDir(); err == nil {
+		catalogDir = filepath.Join(dir, "kd6ctl", "presets")
+	}
+	presetFlagSet := flag.NewFlagSet("kd6ctl preset", flag.ExitOnError)
+	presetCatalog := presetFlagSet.String("catalog", catalogDir, "directory of named presets")
+	catalog := func() kd6rmx.Catalog { return kd6rmx.Catalog{Dir: *presetCatalog} }
+
+	presetList := &ffcli.Command{
+		Name:       "list",
+		ShortUsage: "kd6ctl preset list",
+		ShortHelp:  "List the named presets.",
+		Exec: func(ctx context.Context, args []string) error {
+			recipes, err := catalog().List()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			defer w.Flush()
+			for _, r := range recipes {
+				fmt.Fprintf(w, "%s\t%s\n", r.Name, r.Description)
+			}
+			return nil
+		},
+	}
+
+	presetShow := &ffcli.Command{
+		Name:       "show",
+		ShortUsage: "kd6ctl preset show <name>",
+		ShortHelp:  "Show the settings of a named preset.",
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("show requires the name of the preset")
+			}
+
+			r, err := catalog().Get(args[0])
+			if err != nil {
+				return err
+			}
+			data, err := kd6rmx.EncodeSettings(r.Settings, "yaml")
+			if err != nil {
+				return err
+			}
+			if r.Description != "" {
+				fmt.Printf("# %s\n", r.Description)
+			}
+			_, err = os.Stdout.Write(data)
+			return err
+		},
+	}
+
+	presetPushFlagSet := flag.NewFlagSet("kd6ctl preset push", flag.ExitOnError)
+	presetPushLoad := presetPushFlagSet.Bool("load", false, "also load the preset, making it active")
+
+	presetPush := &ffcli.Command{
+		Name:       "push",
+		ShortUsage: "kd6ctl preset push [-load] <name> <preset>",
+		ShortHelp:  "Save a named preset into a user preset of CIS.",
+		FlagSet:    presetPushFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("push requires the name of the preset and the user preset to save it to")
+			}
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return err
+			}
+
+			r, err := catalog().Get(args[0])
+			if err != nil {
+				return err
+			}
+
+			conn, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			if err := conn.PushRecipe(r, n); err != nil {
+				return err
+			}
+			if *presetPushLoad {
+				return conn.LoadSettings(n)
+			}
+			return nil
+		},
+	}
+
+	presetPullFlagSet := flag.NewFlagSet("kd6ctl preset pull", flag.ExitOnError)
+	presetPullDescription := presetPullFlagSet.String("d", "", "description of the named preset")
+
+	presetPull := &ffcli.Command{
+		Name:       "pull",
+		ShortUsage: "kd6ctl preset pull [-d <description>] <preset> <name>",
+		ShortHelp:  "Store a user preset of CIS as a named preset.",
+		FlagSet:    presetPullFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("pull requires the user preset to read and the name to store it as")
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+
+			r := kd6rmx.Recipe{Name: args[1], Description: *presetPullDescription}
+			if r.Description == "" {
+				// keep the description of the preset being replaced
+				if old, err := catalog().Get(r.Name); err == nil {
+					r.Description = old.Description
+				}
+			}
+
+			conn, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			if r.Settings, err = conn.ReadPreset(n); err != nil {
+				return err
+			}
+			return catalog().Put(r)
+		},
+	}
+
+	preset := &ffcli.Command{
+		Name:        "preset",
+		ShortUsage:  "kd6ctl preset [-catalog <dir>] <list/show/push/pull>",
+		ShortHelp:   "Manage named presets kept on this computer.",
+		FlagSet:     presetFlagSet,
+		Subcommands: []*ffcli.Command{presetList, presetShow, presetPush, presetPull},
+		Exec: func(context.Context, []string) error {
+			return flag.ErrHelp
+		},
+	}
+
+	calibrateFlagSet := flag.NewFlagSet("kd6ctl calibrate", flag.ExitOnError)
+	calibrateLEDs := calibrateFlagSet.String("leds", "", "LEDs to use for the white correction (a, b or ab), or the ones that are on if empty")
+	calibrateTarget := calibrateFlagSet.Int("target", 0, "white correction target (1-255), or the current one if 0")
+	calibrateSave := calibrateFlagSet.Int("save", 0, "user preset to save the result to, or none if 0")
+	calibrateYes := calibrateFlagSet.Bool("y", false, "do not ask the operator to get the sensor ready")
+
+	calibrate := &ffcli.Command{
+		Name:       "calibrate",
+		ShortUsage: "kd6ctl calibrate [-leds <leds>] [-target <value>] [-save <preset>] [-y]",
+		ShortHelp:  "Perform dark and white correction, guiding the operator.",
+		FlagSet:    calibrateFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			in := bufio.NewReader(os.Stdin)
+			c := kd6rmx.Calibration{
+				LEDs:        *calibrateLEDs,
+				WhiteTarget: *calibrateTarget,
+				Preset:      *calibrateSave,
+				Prepare: func(step kd6rmx.CalibrationStep) error {
+					if *calibrateYes {
+						fmt.Printf("performing %s correction\n", step)
+						return nil
+					}
+					switch step {
+					case kd6rmx.CalibrateDark:
+						fmt.Print("Cover the sensor so that no light reaches it, then press Enter. ")
+					case kd6rmx.CalibrateWhite:
+						fmt.Print("Put the white reference in front of the sensor, then press Enter. ")
+					}
+					if _, err := in.ReadString('\n'); err != nil {
+						return fmt.Errorf("calibration cancelled: %v", err)
+					}
+					return nil
+				},
+			}
+
+			conn, err := newSensor(ctx).Open()
+			if err != nil {
+				return err
+			}
+
+			err = conn.Do(func(cis kd6rmx.Sensor) error {
+				return cis.Calibrate(c)
+			})
+			if err != nil {
+				return err
+			}
+			if c.Preset != 0 {
+				fmt.Printf("calibration done, saved to preset %d\n", c.Preset)
+			} else {
+				fmt.Println("calibration done")
+			}
 			return nil
 		},
 	}
@@ -396,7 +887,7 @@ func main() {
 		Name:       "cmd",
 		ShortUsage: "kd6ctl cmd <register> <value>",
 		ShortHelp:  "Sends the specified command to sensor",
-		Exec: func(_ context.Context, args []string) error {
+		Exec: func(ctx context.Context, args []string) error {
 			if len(args) < 2 {
 				return fmt.Errorf("cmd command requires specific register and value you want to send")
 			}
@@ -404,9 +895,12 @@ func main() {
 			register := args[0]
 			command := args[1]
 
-			cis := kd6rmx.Sensor{Port: *port, Logging: *logging, FileLogging: *logFile}
-			cis.SendCommand(register, command)
-			return nil
+			cis := newSensor(ctx)
+			result, err := cis.SendCommand(register, command)
+			if result != "" {
+				fmt.Println(result)
+			}
+			return err
 		},
 	}
 
@@ -414,14 +908,217 @@ func main() {
 		ShortUsage:  "kd6ctl [flags] <subcommand>",
 		ShortHelp:   "kd6ctl is a command line utility to change config on the KD6RMX contact image sensor.",
 		FlagSet:     rootFlagSet,
-		Subcommands: []*ffcli.Command{version, dumpreg, gain, load, save, pattern, outputfreq, outputfmt, interp, dark, white, leds, duty, illum, cmd},
+		Subcommands: []*ffcli.Command{version, discover, dumpreg, identity, model, apply, export, baud, gain, load, save, backup, restore, preset, pattern, outputfreq, outputfmt, interp, dark, white, calibrate, leds, duty, illum, cmd},
 		Exec: func(context.Context, []string) error {
 			return flag.ErrHelp
 		},
 	}
 
-	if err := root.ParseAndRun(context.Background(), os.Args[1:]); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := root.Parse(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
+
+	var logWriters []io.Writer
+	if *logging {
+		logWriters = append(logWriters, os.Stderr)
+	}
+	if *logFile && *logPath == "" {
+		*logPath = "kd6cmd.log"
+	}
+	if *logPath != "" {
+		f, err := os.OpenFile(*logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot open log file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		logWriters = append(logWriters, f)
+	}
+	if len(logWriters) > 0 {
+		logger = kd6rmx.NewTextLogger(io.MultiWriter(logWriters...))
+	}
+
+	if *record != "" {
+		f, err := os.OpenFile(*record, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot open transcript file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		observer = kd6rmx.NewTranscriptRecorder(f)
+	}
+
+	if *modelFlag != "" {
+		m, err := lookupModel(newSensor(ctx), *modelFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		cisModel = &m
+	}
+
+	err := root.Run(ctx)
+	if transport != nil {
+		transport.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+// dumpRegisters prints the current register values of the sensor. It keeps
+// going if reading a register fails, and returns the last error.
+func dumpRegisters(cis kd6rmx.Sensor) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	var lastErr error
+	show := func(name string, err error, format string, a ...interface{}) {
+		if err != nil {
+			fmt.Fprintf(w, "%s:\terror: %v\n", name, err)
+			lastErr = err
+			return
+		}
+		fmt.Fprintf(w, "%s:\t"+format+"\n", append([]interface{}{name}, a...)...)
+	}
+	onOff := func(on bool) string {
+		if on {
+			return "on"
+		}
+		return "off"
+	}
+
+	baud, err := cis.ReadCommunicationSpeed()
+	show("Communication speed", err, "%d baud", baud)
+
+	freq, err := cis.ReadOutputFrequency()
+	show("Output frequency", err, "%.1f MHz", freq)
+
+	format, err := cis.ReadPixelOutputFormat()
+	show("Output format", err, "%s", format)
+
+	overlap, err := cis.ReadPixelOverlap()
+	show("Overlap", err, "%s", onOff(overlap))
+
+	interp, err := cis.ReadPixelInterpolation()
+	show("Interpolation", err, "%s", onOff(interp))
+
+	res, err := cis.ReadPixelResolution()
+	show("Resolution", err, "%d dpi", res)
+
+	external, clock, err := cis.ReadSync()
+	if external {
+		show("Sync", err, "external")
+	} else {
+		show("Sync", err, "internal (clock %d)", clock)
+	}
+
+	leds, pulse, err := cis.ReadLEDControl()
+	if leds == "" {
+		leds = "off"
+	}
+	show("LEDs", err, "%s (pulse divider %d)", leds, pulse)
+
+	dutyA, err := cis.ReadLEDDutyCycle("A")
+	show("LED duty A", err, "%d", dutyA)
+
+	dutyB, err := cis.ReadLEDDutyCycle("B")
+	show("LED duty B", err, "%d", dutyB)
+
+	period, err := cis.ReadLEDIlluminationPeriod()
+	show("LED illumination period", err, "%d", period)
+
+	dark, err := cis.ReadDarkCorrectionEnabled()
+	show("Dark correction", err, "%s", onOff(dark))
+
+	white, err := cis.ReadWhiteCorrectionEnabled()
+	show("White correction", err, "%s", onOff(white))
+
+	pattern, err := cis.ReadTestPatternEnabled()
+	show("Test pattern", err, "%s", onOff(pattern))
+
+	patternType, err := cis.ReadTestPattern()
+	if patternType == kd6rmx.TestPatternRamp {
+		show("Test pattern type", err, "ramp")
+	} else {
+		show("Test pattern type", err, "stripe")
+	}
+
+	sn, err := cis.ReadSerialNumber()
+	show("Serial number", err, "%s", sn)
+
+	pga, gain, err := cis.ReadGainAmplifier()
+	show("Gain amplifier", err, "%s (level %+d)", onOff(pga), gain)
+
+	return lastErr
+}
+
+// printModel prints a model and what it supports.
+func printModel(m kd6rmx.Model) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	orAny := func(s string) string {
+		if s == "" {
+			return "any"
+		}
+		return s
+	}
+
+	fmt.Fprintf(w, "Model:\t%s\n", m.Name)
+	fmt.Fprintf(w, "Product number:\t%04X\n", m.ProductNumber)
+	if m.Chips > 0 {
+		fmt.Fprintf(w, "Sensor chips:\t%d\n", m.Chips)
+	}
+	if m.ActiveWidth > 0 {
+		fmt.Fprintf(w, "Active width:\t%g mm\n", m.ActiveWidth)
+	}
+	fmt.Fprintf(w, "Resolutions:\t%s\n", orAny(strings.Trim(fmt.Sprint(m.Resolutions), "[]")))
+	fmt.Fprintf(w, "Output frequencies:\t%s\n", orAny(strings.Trim(fmt.Sprint(m.OutputFrequencies), "[]")))
+
+	var formats []string
+	for _, f := range m.OutputFormats {
+		formats = append(formats, f.String())
+	}
+	fmt.Fprintf(w, "Output formats:\t%s\n", orAny(strings.Join(formats, ", ")))
+	fmt.Fprintf(w, "LEDs:\t%s\n", orAny(m.LEDs))
+	return nil
+}
+
+// lookupModel returns the model given with -model, which is either a product
+// number in hex, or "detect" to read it from the sensor. As with DetectModel,
+// unregistered product numbers get the generic model.
+func lookupModel(cis kd6rmx.Sensor, name string) (kd6rmx.Model, error) {
+	if name == "detect" {
+		return cis.DetectModel()
+	}
+
+	n, err := strconv.ParseUint(name, 16, 16)
+	if err != nil {
+		return kd6rmx.Model{}, fmt.Errorf("invalid model %q, must be a product number or 'detect'", name)
+	}
+	if m, ok := kd6rmx.LookupModel(int(n)); ok {
+		return m, nil
+	}
+	m := kd6rmx.GenericModel
+	m.ProductNumber = int(n)
+	return m, nil
+}
+
+// stringsFlag is a flag that can be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
@@ -0,0 +1,195 @@
+// kd6d is a daemon that gives access to KD6RMX contact image sensors over HTTP/JSON.
+//
+// Each sensor is given a name, which is used in the URLs of the API:
+//
+//	kd6d line1=/dev/corser/XtiumCLMX41_s0 line2=tcp://10.0.0.5:4001
+//	curl http://localhost:8080/sensors/line1/settings
+//
+// The API has no authentication, and lets anyone who can reach it send raw
+// commands to the sensors and reset them. kd6d only listens on localhost
+// unless told otherwise with -addr; only listen on other interfaces on a
+// trusted network, or behind a proxy that authenticates.
+//
+// kd6ctl can use the sensors with the -remote flag:
+//
+//	kd6ctl -remote http://localhost:8080/sensors/line1 dumpreg
+//
+// See package remote for the API. Prometheus metrics for all sensors are
+// served at /metrics, see package metrics.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/northvolt/go-kd6rmx"
+	"github.com/northvolt/go-kd6rmx/metrics"
+	"github.com/northvolt/go-kd6rmx/remote"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func main() {
+	var (
+		flags   = flag.NewFlagSet("kd6d", flag.ExitOnError)
+		addr    = flags.String("addr", "127.0.0.1:8080", "address to listen on; the API has no authentication")
+		logging = flags.Bool("log", false, "turn on debug logging of every command")
+		timeout = flags.Duration("timeout", 10*time.Second, "how long to wait for each reply from the sensors")
+		record  = flags.String("record", "", "append a transcript of all commands to this file")
+		poll    = flags.Duration("poll", time.Minute, "how often to read the state of the sensors for metrics, or 0 to never")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: kd6d [flags] <name>=<port>...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cis := kd6rmx.Sensor{Timeout: *timeout}
+	if *logging {
+		cis.Logger = kd6rmx.NewTextLogger(os.Stderr)
+	}
+
+	if *record != "" {
+		f, err := os.OpenFile(*record, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot open transcript file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		cis.Observer = kd6rmx.NewTranscriptRecorder(f)
+	}
+
+	if err := run(*addr, *poll, flags.Args(), cis); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the sensors given as name=port arguments, each opened with the
+// options of cis. Sensors that cannot be opened are logged and left out, as
+// long as at least one can be.
+func run(addr string, poll time.Duration, args []string, cis kd6rmx.Sensor) error {
+	m := metrics.New()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m, collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if cis.Observer != nil {
+		cis.Observer = kd6rmx.MultiObserver(m, cis.Observer)
+	} else {
+		cis.Observer = m
+	}
+
+	logger := cis.Logger
+	if logger == nil {
+		logger = kd6rmx.NewTextLogger(os.Stderr)
+	}
+
+	sensors := make(map[string]*kd6rmx.Conn)
+	given := make(map[string]bool)
+	defer func() {
+		for _, conn := range sensors {
+			conn.Close()
+		}
+	}()
+
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid sensor %q, must be <name>=<port>", arg)
+		}
+		name, port := arg[:i], arg[i+1:]
+		if given[name] {
+			return fmt.Errorf("sensor %q given more than once", name)
+		}
+		given[name] = true
+
+		// a sensor that cannot be opened or does not answer is logged,
+		// rather than keeping the others from being served.
+		cis.Port = port
+		conn, err := cis.Open()
+		if err != nil {
+			logger.Error("cannot open sensor, not serving it", "sensor", name, "port", port, "error", err)
+			continue
+		}
+		sensors[name] = conn
+
+		// reject settings the model cannot do before they reach the sensor.
+		model, err := conn.DetectModel()
+		if err != nil {
+			logger.Error("cannot detect model, serving sensor without one", "sensor", name, "port", port, "error", err)
+			continue
+		}
+		logger.Debug("serving sensor", "sensor", name, "port", port, "model", model)
+	}
+	if len(sensors) == 0 {
+		return errors.New("none of the sensors could be opened")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", remote.NewHandler(sensors))
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	if poll > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go updateMetrics(m, sensors, poll, stop, logger)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	logger.Debug("listening", "addr", addr)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-sigc:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// updateMetrics reads the state of the sensors into m every interval, until
+// stop is closed.
+func updateMetrics(m *metrics.Metrics, sensors map[string]*kd6rmx.Conn, interval time.Duration, stop <-chan struct{}, logger kd6rmx.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for name, conn := range sensors {
+			if err := m.Update(conn.Sensor); err != nil {
+				logger.Error("cannot update metrics", "sensor", name, "error", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
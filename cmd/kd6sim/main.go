@@ -0,0 +1,109 @@
+// kd6sim is a fake KD-MX contact image sensor that answers commands on a pseudo-terminal.
+//
+// It prints the path of the pseudo-terminal, which can then be used as the port for kd6ctl:
+//
+//	kd6sim &
+//	kd6ctl -p /dev/pts/3 dumpreg
+//
+// With -listen it instead acts as a serial-to-Ethernet converter that passes
+// data through unchanged:
+//
+//	kd6sim -listen localhost:4001 &
+//	kd6ctl -p tcp://localhost:4001 dumpreg
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/northvolt/go-kd6rmx/sim"
+)
+
+func main() {
+	var (
+		flags  = flag.NewFlagSet("kd6sim", flag.ExitOnError)
+		link   = flags.String("link", "", "create a symlink to the pseudo-terminal at this path")
+		listen = flags.String("listen", "", "listen for TCP connections on this address instead of using a pseudo-terminal")
+	)
+	flags.Parse(os.Args[1:])
+
+	var err error
+	if *listen != "" {
+		err = runTCP(*listen)
+	} else {
+		err = run(*link)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(link string) error {
+	p, err := openPTY()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	if link != "" {
+		if err := os.Symlink(p.Name(), link); err != nil {
+			return err
+		}
+		defer os.Remove(link)
+	}
+
+	fmt.Println(p.Name())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sim.New().Serve(p)
+	}()
+
+	return wait(errc)
+}
+
+func runTCP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	fmt.Println(l.Addr())
+
+	s := sim.New()
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				errc <- err
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s.Serve(conn)
+			}()
+		}
+	}()
+
+	return wait(errc)
+}
+
+func wait(errc <-chan error) error {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-sigc:
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// pty is the master side of a pseudo-terminal. The slave side is kept open
+// as well, so that clients opening and closing the slave for every command
+// do not cause reads on the master to fail.
+type pty struct {
+	master *os.File
+	slave  *os.File
+}
+
+// openPTY opens a new pseudo-terminal, and puts its slave side in raw mode
+// so that command frames reach the simulator unmodified.
+func openPTY() (*pty, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("unlocking pseudo-terminal: %v", err)
+	}
+
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("getting pseudo-terminal number: %v", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	var t syscall.Termios
+	if err := ioctl(slave, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := ioctl(slave, syscall.TCSETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, err
+	}
+
+	return &pty{master: master, slave: slave}, nil
+}
+
+// Name returns the path of the slave side of the pseudo-terminal.
+func (p *pty) Name() string {
+	return p.slave.Name()
+}
+
+func (p *pty) Read(b []byte) (int, error) {
+	return p.master.Read(b)
+}
+
+func (p *pty) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+func (p *pty) Close() error {
+	p.slave.Close()
+	return p.master.Close()
+}
+
+func ioctl(f *os.File, req uint, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(req), arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+type pty struct {
+	io.ReadWriteCloser
+}
+
+func openPTY() (*pty, error) {
+	return nil, errors.New("pseudo-terminals are only supported on linux")
+}
+
+func (p *pty) Name() string {
+	return ""
+}
@@ -0,0 +1,138 @@
+package kd6rmx
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Conn is a connection to a sensor that stays open across commands, instead
+// of opening the port for every command.
+//
+// Conn embeds a Sensor whose Transport is the open connection, so all of the
+// Sensor methods can be used on it directly, and the Sensor can be passed on
+// by value:
+//
+//	conn, err := kd6rmx.Sensor{Port: "/dev/your-port-here"}.Open()
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close()
+//
+//	conn.PixelResolution(600)
+//	settings, err := conn.ReadSettings()
+//
+// A Conn is safe for concurrent use. Each command and its reply are
+// exchanged without interruption from other goroutines using the same Conn,
+// or copies of its Sensor. Use Do to run a sequence of commands without
+// interruption.
+type Conn struct {
+	Sensor
+}
+
+// Open opens a connection to the sensor at port.
+func Open(port string) (*Conn, error) {
+	return Sensor{Port: port}.Open()
+}
+
+// Open opens a connection to the sensor at its Port, keeping the rest of
+// its options. If the sensor already has a Transport, the connection uses it
+// instead, and closing the connection closes the transport.
+func (cis Sensor) Open() (*Conn, error) {
+	if cis.Transport == nil {
+		t, err := Dial(cis.Port)
+		if err != nil {
+			return nil, err
+		}
+		cis.Transport = t
+	}
+	cis.sem = make(chan struct{}, 1)
+	return &Conn{Sensor: cis}, nil
+}
+
+// NewConn returns a connection to a sensor using an already open transport.
+// Closing the connection closes the transport.
+func NewConn(t Transport) *Conn {
+	markStale(t)
+	return &Conn{Sensor: Sensor{Transport: t, sem: make(chan struct{}, 1)}}
+}
+
+// Do calls fn with exclusive use of the connection, so that other goroutines
+// cannot send commands in between those sent by fn. The sensor passed to fn
+// must not be used after fn returns.
+func (c *Conn) Do(fn func(cis Sensor) error) error {
+	ctx := c.context()
+	select {
+	case c.sem <- struct{}{}:
+		defer func() { <-c.sem }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	cis := c.Sensor
+	cis.sem = nil
+	return fn(cis)
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return closeTransport(c.Transport)
+}
+
+// Dial opens a transport to the sensor at port, which is either:
+//
+//   - the path of a device file that is already configured, such as the
+//     serial port of a Camera Link frame grabber, for example
+//     /dev/corser/XtiumCLMX41_s0.
+//   - a serial:// URL for a serial port that is configured by the host,
+//     for example serial:///dev/ttyUSB0?baud=115200. See OpenSerial.
+//   - a tcp:// URL for a serial-to-Ethernet converter that passes data
+//     through unchanged, for example tcp://10.0.0.5:4001. See DialTCP.
+//   - an rfc2217:// URL for a serial-to-Ethernet converter that supports
+//     RFC 2217, for example rfc2217://10.0.0.5:4001?baud=115200. See
+//     DialRFC2217.
+//   - a replay:// URL for a transcript to replay instead of a sensor, for
+//     example replay:///tmp/transcript.jsonl. See OpenReplay.
+//
+// The serial:// and rfc2217:// URLs take the options baud, parity (none,
+// odd or even), stopbits (1 or 2) and flow (none, hardware or software),
+// which default to DefaultSerialConfig.
+//
+// Any input left from before the transport was opened is drained before
+// its first command.
+func Dial(port string) (Transport, error) {
+	t, err := dial(port)
+	if err != nil {
+		return nil, err
+	}
+	markStale(t)
+	return t, nil
+}
+
+func dial(port string) (Transport, error) {
+	scheme := port[:strings.Index(port, ":")+1]
+	switch scheme {
+	case "serial:", "tcp:", "rfc2217:":
+	case "replay:":
+		return OpenReplay(strings.TrimPrefix(port, "replay://"))
+	default:
+		return OpenFileTransport(port)
+	}
+
+	u, err := url.Parse(port)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseSerialConfig(u.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "serial":
+		return OpenSerial(u.Path, config)
+	case "tcp":
+		return DialTCP(u.Host)
+	default:
+		return DialRFC2217(u.Host, config)
+	}
+}
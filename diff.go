@@ -0,0 +1,51 @@
+package kd6rmx
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// SettingChange is a single field that differs between two Settings.
+type SettingChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// String returns the change as "Field: old -> new".
+func (c SettingChange) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New)
+}
+
+// DiffSettings returns every field that differs between the old and new
+// settings, in the order they are declared in Settings.
+//
+// InternalSyncClock is only compared when new uses internal sync, since the
+// clock is not used by the sensor otherwise.
+func DiffSettings(old, new Settings) []SettingChange {
+	var changes []SettingChange
+
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < ov.NumField(); i++ {
+		field := ov.Type().Field(i).Name
+		if field == "InternalSyncClock" && new.ExternalSync {
+			continue
+		}
+
+		o, n := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if o != n {
+			changes = append(changes, SettingChange{Field: field, Old: o, New: n})
+		}
+	}
+	return changes
+}
+
+// Diff reads the current settings of the sensor, and returns how they
+// differ from the desired settings.
+func (cis Sensor) Diff(desired Settings) ([]SettingChange, error) {
+	current, err := cis.ReadSettings()
+	if err != nil {
+		return nil, err
+	}
+	return DiffSettings(current, desired), nil
+}
@@ -0,0 +1,120 @@
+package kd6rmx
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// DiscoveryPatterns are the device paths searched by DiscoverPorts. Paths
+// matching a pattern with Serial set are serial ports that must be
+// configured by the host, and are probed with serial:// URLs.
+var DiscoveryPatterns = []struct {
+	Glob   string
+	Serial bool
+}{
+	{Glob: "/dev/corser/*"},
+	{Glob: "/dev/ttyUSB*", Serial: true},
+	{Glob: "/dev/ttyS*", Serial: true},
+}
+
+// DiscoveredSensor is a sensor found by Discover.
+type DiscoveredSensor struct {
+	// Port can be used as the Port of a Sensor to use the sensor, and
+	// includes the baud rate for serial ports.
+	Port     string     `json:"port"`
+	Info     DeviceInfo `json:"info"`
+	BaudRate int        `json:"baud_rate"`
+}
+
+// DiscoverPorts returns the ports that may have a sensor attached, from
+// DiscoveryPatterns.
+func DiscoverPorts() []string {
+	var ports []string
+	for _, p := range DiscoveryPatterns {
+		matches, _ := filepath.Glob(p.Glob)
+		for _, m := range matches {
+			if p.Serial {
+				m = "serial://" + m
+			}
+			ports = append(ports, m)
+		}
+	}
+	return ports
+}
+
+// Discover probes each of ports for a sensor with a harmless read-back of
+// the SI register, and returns the sensors found, in the order of ports.
+// Ports are probed in parallel, and ports without a sensor are skipped.
+//
+// Ports are as for Dial, for example the result of DiscoverPorts with any
+// TCP serial-to-Ethernet converters added. If the transport can change the
+// host baud rate, the speed of the sensor is probed first.
+func Discover(ctx context.Context, ports []string) []DiscoveredSensor {
+	found := make([]*DiscoveredSensor, len(ports))
+
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i int, port string) {
+			defer wg.Done()
+			if d, err := probe(ctx, port); err == nil {
+				found[i] = &d
+			}
+		}(i, port)
+	}
+	wg.Wait()
+
+	var sensors []DiscoveredSensor
+	for _, d := range found {
+		if d != nil {
+			sensors = append(sensors, *d)
+		}
+	}
+	return sensors
+}
+
+// probe looks for a sensor at port.
+func probe(ctx context.Context, port string) (DiscoveredSensor, error) {
+	t, err := Dial(port)
+	if err != nil {
+		return DiscoveredSensor{}, err
+	}
+	defer t.Close()
+
+	cis := Sensor{Port: port, Transport: t, Timeout: probeTimeout}.WithContext(ctx)
+
+	var baud int
+	if _, ok := t.(BaudRateSetter); ok {
+		baud, err = cis.ProbeBaudRate()
+	} else {
+		baud, err = cis.ReadCommunicationSpeed()
+	}
+	if err != nil {
+		return DiscoveredSensor{}, err
+	}
+
+	info, err := cis.Identity()
+	if err != nil {
+		return DiscoveredSensor{}, err
+	}
+
+	if _, ok := t.(BaudRateSetter); ok {
+		port = setBaudOption(port, baud)
+	}
+	return DiscoveredSensor{Port: port, Info: info, BaudRate: baud}, nil
+}
+
+// setBaudOption sets the baud option of a serial:// or rfc2217:// port.
+func setBaudOption(port string, baud int) string {
+	u, err := url.Parse(port)
+	if err != nil {
+		return port
+	}
+	q := u.Query()
+	q.Set("baud", strconv.Itoa(baud))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
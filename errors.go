@@ -0,0 +1,83 @@
+package kd6rmx
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported by the sensor in the status code of its reply, or found
+// when checking the reply. They are wrapped in a *ProtocolError, and can be
+// tested for with errors.Is.
+var (
+	ErrInvalidCommand   = errors.New("invalid command")
+	ErrInvalidParameter = errors.New("invalid parameter")
+	ErrBusy             = errors.New("sensor busy")
+	ErrChecksum         = errors.New("checksum error")
+
+	// ErrInvalidReply means the reply could not be understood at all.
+	ErrInvalidReply = errors.New("invalid reply")
+
+	// ErrReplyMismatch means the reply is not for the command that was sent,
+	// for example a stale reply to an earlier command that timed out.
+	ErrReplyMismatch = errors.New("reply does not match command")
+)
+
+// ErrTimeout is returned when the sensor does not reply in time.
+var ErrTimeout = errors.New("timeout receiving result from command")
+
+// ErrNotSupported is returned by setters when the sensor's Model cannot do
+// the setting. Nothing is sent to the sensor.
+var ErrNotSupported = errors.New("not supported")
+
+// statusErrors maps the status codes that start every reply to their errors.
+// Status code 00 means success.
+var statusErrors = map[string]error{
+	"01": ErrInvalidCommand,
+	"02": ErrInvalidParameter,
+	"03": ErrBusy,
+	"04": ErrChecksum,
+}
+
+// ProtocolError is returned when the sensor rejects a command, or sends a
+// reply that cannot be understood.
+type ProtocolError struct {
+	Command string
+	Params  string
+	Reply   string
+
+	// Err is one of the Err* errors of this package, or nil if the sensor
+	// replied with an unknown status code.
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s%s: unknown status in reply %q", e.Command, e.Params, e.Reply)
+	}
+	return fmt.Sprintf("%s%s: %v (reply %q)", e.Command, e.Params, e.Err, e.Reply)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the status code of the reply, or "" if the reply is too
+// short to have one.
+func (e *ProtocolError) Status() string {
+	if len(e.Reply) < 2 {
+		return ""
+	}
+	return e.Reply[:2]
+}
+
+// checkStatus returns a *ProtocolError if the reply to the command does not
+// have status code 00.
+func checkStatus(cmd, params, reply string) error {
+	if len(reply) < 2 {
+		return &ProtocolError{Command: cmd, Params: params, Reply: reply, Err: ErrInvalidReply}
+	}
+	if reply[:2] == "00" {
+		return nil
+	}
+	return &ProtocolError{Command: cmd, Params: params, Reply: reply, Err: statusErrors[reply[:2]]}
+}
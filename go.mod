@@ -2,4 +2,21 @@ module github.com/northvolt/go-kd6rmx
 
 go 1.17
 
-require github.com/peterbourgon/ff/v3 v3.1.0
+require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/peterbourgon/ff/v3 v3.1.0
+	github.com/prometheus/client_golang v1.12.2
+	golang.org/x/sys v0.10.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
+)
@@ -0,0 +1,87 @@
+package kd6rmx
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DeviceInfo identifies a single sensor, as reported by the SI register.
+// The SI register has no firmware version.
+type DeviceInfo struct {
+	// ProductNumber is the product number of the model, see DetectModel.
+	ProductNumber int `json:"product_number" yaml:"product_number" toml:"product_number"`
+
+	// SerialNumber is the serial number as printed on the sensor, which is
+	// made up of all of the other fields.
+	SerialNumber string `json:"serial_number" yaml:"serial_number" toml:"serial_number"`
+
+	// ID tells apart sensors of the same model made in the same month.
+	ID int `json:"id" yaml:"id" toml:"id"`
+
+	// Month and Year are when the sensor was manufactured.
+	Month int `json:"month" yaml:"month" toml:"month"`
+	Year  int `json:"year" yaml:"year" toml:"year"`
+}
+
+// String returns the serial number and product number of the sensor.
+func (d DeviceInfo) String() string {
+	return fmt.Sprintf("%s (product number %04X, made %04d-%02d)", d.SerialNumber, d.ProductNumber, d.Year, d.Month)
+}
+
+// Identity reads the product number, serial number and manufacturing date
+// of the sensor.
+func (cis Sensor) Identity() (DeviceInfo, error) {
+	result, err := cis.readRegister("SI", "C0")
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	info, err := parseIdentity(result)
+	if err != nil {
+		return DeviceInfo{}, &ProtocolError{Command: "SI", Params: "C0", Reply: result, Err: ErrInvalidReply}
+	}
+	return info, nil
+}
+
+// parseIdentity decodes a reply to SI C0, which is the status, the echoed
+// sub-register, and the product number low byte first, ID, month and year.
+func parseIdentity(result string) (DeviceInfo, error) {
+	sn, err := parseName(result)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	pn, err := strconv.ParseUint(result[6:8]+result[4:6], 16, 16)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	id, err := strconv.ParseUint(result[8:10], 16, 8)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	month, err := parseDateField(result[10:12])
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	year, err := parseDateField(result[12:14])
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	return DeviceInfo{
+		ProductNumber: int(pn),
+		SerialNumber:  sn,
+		ID:            int(id),
+		Month:         month,
+		Year:          2000 + year,
+	}, nil
+}
+
+// parseDateField decodes a month or a year of the century, which the
+// sensor reports in BCD so that they read the same in the serial number.
+func parseDateField(s string) (int, error) {
+	if v, err := strconv.Atoi(s); err == nil {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 16, 8)
+	return int(v), err
+}
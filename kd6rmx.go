@@ -1,24 +1,67 @@
 package kd6rmx
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
 // Sensor is a wrapper for control functions for the KD6RMX contact image sensor.
 type Sensor struct {
-	Port        string
-	Logging     bool
-	FileLogging bool
+	Port string
+
+	// Transport, if set, is used to exchange commands with the sensor instead
+	// of opening Port for each command. The Sensor never closes it.
+	Transport Transport
+
+	// Timeout is how long to wait for the reply to each command. If zero,
+	// a timeout of 10 seconds is used.
+	Timeout time.Duration
+
+	// Observer, if set, is notified of every command sent to the sensor.
+	Observer Observer
+
+	// Logger, if set, receives a log record for every command sent to the
+	// sensor.
+	Logger Logger
+
+	// Model, if set, makes the setters reject settings the model cannot do.
+	// See DetectModel.
+	Model *Model
+
+	ctx context.Context
+
+	// sem, if set, is held for each command/reply exchange. It is shared by
+	// all copies of the sensor made from a Conn.
+	sem chan struct{}
+}
+
+// WithContext returns a copy of the sensor that uses ctx for all of its
+// operations. Waiting for replies, and the waits after commands such as
+// SoftwareReset, stop early with ctx.Err() when ctx is done.
+//
+// For example:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//	defer cancel()
+//	err := cis.WithContext(ctx).PixelResolution(600)
+func (cis Sensor) WithContext(ctx context.Context) Sensor {
+	cis.ctx = ctx
+	return cis
 }
 
-// CommunicationSpeed sets the communcation speed.
+func (cis Sensor) context() context.Context {
+	if cis.ctx == nil {
+		return context.Background()
+	}
+	return cis.ctx
+}
+
+// CommunicationSpeed sets the communcation speed. Valid speeds are 9600,
+// 19200, or 115200 baud. If the sensor's Transport is a BaudRateSetter, the
+// host side is switched to the new speed as well.
 func (cis Sensor) CommunicationSpeed(baud int) error {
 	var param string
 	switch baud {
@@ -32,8 +75,16 @@ func (cis Sensor) CommunicationSpeed(baud int) error {
 		return errors.New("invalid baud rate")
 	}
 
-	_, err := cis.SendCommand("BR", param)
-	return err
+	if _, err := cis.SendCommand("BR", param); err != nil {
+		return err
+	}
+
+	// switch the host side of the serial line as well, if we can
+	if bs, ok := cis.Transport.(BaudRateSetter); ok {
+		markStale(cis.Transport)
+		return bs.SetBaudRate(baud)
+	}
+	return nil
 }
 
 // OutputFrequency sets the output frequency.
@@ -102,6 +153,11 @@ func (cis Sensor) OutputFrequency(freq float32) error {
 		return errors.New("invalid output frequency")
 	}
 
+	supported := func(m Model) bool { return m.SupportsOutputFrequency(freq) }
+	if err := cis.checkModel(supported, "output frequency %.1f MHz", freq); err != nil {
+		return err
+	}
+
 	result, err := cis.SendCommand("OF", val)
 	if err != nil {
 		return err
@@ -216,6 +272,12 @@ func (cis Sensor) PixelOutputFormat(bits PixelOutputBits, i PixelOutputInterface
 		return errors.New("invalid params for PixelOutputFormat")
 	}
 
+	format := OutputFormat{Bits: bits, Interface: i, Config: conf, Number: number}
+	supported := func(m Model) bool { return m.SupportsOutputFormat(format) }
+	if err := cis.checkModel(supported, "output format %s", format); err != nil {
+		return err
+	}
+
 	result, err := cis.SendCommand("OC", param)
 	if err != nil {
 		return err
@@ -223,12 +285,17 @@ func (cis Sensor) PixelOutputFormat(bits PixelOutputBits, i PixelOutputInterface
 	return checkError("PixelOutputFormat", result)
 }
 
-// PixelOverlap turns on/off the pixel overlap. Only to be used on CIS with 2 or 3 sensors.
+// PixelOverlap turns on/off the pixel overlap. Only to be used on CIS with 2 or 3 sensors,
+// which is checked if the sensor has a Model.
 func (cis Sensor) PixelOverlap(on bool) error {
 	var param = "20"
 	if on {
+		if err := cis.checkModel(Model.SupportsOverlap, "pixel overlap"); err != nil {
+			return err
+		}
 		param = "21"
 	}
+
 	result, err := cis.SendCommand("OC", param)
 	if err != nil {
 		return err
@@ -267,6 +334,11 @@ func (cis Sensor) PixelResolution(res int) error {
 		return errors.New("invalid resolution")
 	}
 
+	supported := func(m Model) bool { return m.SupportsResolution(res) }
+	if err := cis.checkModel(supported, "resolution %d dpi", res); err != nil {
+		return err
+	}
+
 	result, err := cis.SendCommand("RC", param)
 	if err != nil {
 		return err
@@ -286,19 +358,15 @@ func (cis Sensor) ExternalSync() error {
 // InternalSync turns on the internal sync.
 func (cis Sensor) InternalSync(val int) error {
 	if val < 1 || val > 0xffff {
-		errors.New("invalid sync clock value")
+		return errors.New("invalid sync clock value")
 	}
 
-	param := fmt.Sprintf("00%000X", val)
+	param := fmt.Sprintf("00%04X", val)
 	result, err := cis.SendCommand("SS", param)
 	if err != nil {
 		return err
 	}
-
-	if len(result) < 5 {
-		return errors.New("invalid result from set sync")
-	}
-	return nil
+	return checkError("InternalSync", result)
 }
 
 // LoadSettings loads the sensor's active settings with one of the memory presets.
@@ -375,9 +443,16 @@ func (cis Sensor) LEDControl(leds string, on bool, pulsedivider int) error {
 			return errors.New("invalid LEDs, must be 'A', 'B', or 'AB'")
 		}
 	} else {
-		// turn both off.
+		// turn both off, keeping the pulse divider.
 		// TODO: turn back on anything that was on and we did not explicitly turn off.
-		val = 0
+		val = pd * 4
+	}
+
+	if on {
+		supported := func(m Model) bool { return m.SupportsLEDs(leds) }
+		if err := cis.checkModel(supported, "LEDs %s", leds); err != nil {
+			return err
+		}
 	}
 
 	param := fmt.Sprintf("%02X", val)
@@ -405,6 +480,11 @@ func (cis Sensor) LEDDutyCycle(led string, duty int) error {
 	if duty <= 0 || duty >= dutyMax {
 		return errors.New("invalid duty cycle register value")
 	}
+	supported := func(m Model) bool { return m.SupportsLEDs(led) }
+	if err := cis.checkModel(supported, "LED %s", led); err != nil {
+		return err
+	}
+
 	param := fmt.Sprintf("%s%04X", ls, duty)
 
 	result, err := cis.SendCommand("LC", param)
@@ -482,7 +562,9 @@ func (cis Sensor) WhiteCorrectionTarget(target int) error {
 		return err
 	}
 	// sleep for one second to make sure correction finished
-	time.Sleep(1 * time.Second)
+	if err := sleep(cis.context(), 1*time.Second); err != nil {
+		return err
+	}
 	return checkError("WhiteCorrectionTarget", result)
 }
 
@@ -508,7 +590,7 @@ func (cis Sensor) GainAmplifierLevel(gain int) error {
 		return errors.New("invalid negative gain level")
 	case gain < 0:
 		// negative gain
-		param = fmt.Sprintf("21%04X", gain)
+		param = fmt.Sprintf("21%04X", -gain)
 	}
 
 	result, err := cis.SendCommand("PG", param)
@@ -570,11 +652,13 @@ func (cis Sensor) SoftwareReset() error {
 	if err != nil {
 		return err
 	}
-	if len(result) < 4 {
-		return errors.New("invalid result from SoftwareReset")
+	if err := checkError("SoftwareReset", result); err != nil {
+		return err
 	}
 
-	time.Sleep(10 * time.Second)
+	if err := sleep(cis.context(), 10*time.Second); err != nil {
+		return err
+	}
 
 	result, err = cis.SendCommand("SR", "01")
 	if err != nil {
@@ -583,97 +667,100 @@ func (cis Sensor) SoftwareReset() error {
 	return checkError("SoftwareReset", result)
 }
 
+// SendCommand sends a single command with its params to the sensor, and
+// returns the reply. If the sensor rejects the command, or the reply does
+// not match the command, the reply is returned together with a *ProtocolError.
+//
+// If the sensor has a Transport it is used for the exchange, otherwise
+// Port is opened with Dial for the duration of the command. See Open for
+// keeping the port open across commands.
 func (cis Sensor) SendCommand(cmd string, params string) (string, error) {
+	return cis.SendCommandContext(cis.context(), cmd, params)
+}
 
-	f, err := os.OpenFile(cis.Port, os.O_RDWR|os.O_APPEND, 0777)
-	if err != nil {
-		return "", fmt.Errorf("error opening control port: %v", err)
+// SendCommandContext is like SendCommand, but gives up waiting for the
+// reply when ctx is done.
+func (cis Sensor) SendCommandContext(ctx context.Context, cmd string, params string) (reply string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
-	defer f.Close()
 
-	write_string := cmd + params + "\r"
-	dt_string := time.Now().Format("2006-01-02 15:04:05.000000000")
-
-	if cis.FileLogging {
-		f_log, err := os.OpenFile("kd6cmd.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return "", fmt.Errorf("cannot write to log file: %v", err)
-		}
-		defer f_log.Close()
-
-		if _, err := f_log.WriteString(dt_string + "\n"); err != nil {
-			log.Println(err)
-		}
-		if _, err := f_log.WriteString("send: " + write_string + "\n"); err != nil {
-			log.Println(err)
+	if cis.sem != nil {
+		select {
+		case cis.sem <- struct{}{}:
+			defer func() { <-cis.sem }()
+		case <-ctx.Done():
+			return "", ctx.Err()
 		}
 	}
 
-	if cis.Logging {
-		fmt.Printf("%s\n", dt_string)
-		fmt.Println("send: ", write_string)
-	}
-
-	_, err = f.Write([]byte(write_string))
-	if err != nil {
-		return "", fmt.Errorf("error sending command: %v", err)
+	var roundTrip time.Duration
+	if cis.Observer != nil || cis.Logger != nil {
+		e := Exchange{Port: cis.Port, Command: cmd, Params: params, Start: time.Now()}
+		defer func() {
+			e.Reply, e.Err = reply, err
+			e.Duration = time.Since(e.Start)
+			e.RoundTrip = roundTrip
+			if cis.Logger != nil {
+				logExchange(cis.Logger, e)
+			}
+			if cis.Observer != nil {
+				cis.Observer.ObserveExchange(e)
+			}
+		}()
 	}
 
-	buf := make([]byte, 5)
-	var result string
-	start := time.Now()
-	for {
-
-		n, err := f.Read(buf)
+	t := cis.Transport
+	if t == nil {
+		var err error
+		t, err = Dial(cis.Port)
 		if err != nil {
-			if err == io.EOF {
-				if time.Since(start) > time.Second*10 {
-					return "", fmt.Errorf("timeout receiving result from command")
-				}
-				continue
-			}
-
-			// some other error
 			return "", err
 		}
+		defer closeTransport(t)
+	}
 
-		result += string(buf[:n])
-		switch {
-		case result[len(result)-1] == '\r':
-			result = strings.Replace(result, "\r", "", -1)
+	write_string := cmd + params + "\r"
 
-			dt_string_rec := time.Now().Format("2006-01-02 15:04:05.000000000")
-			if cis.FileLogging {
-				f_log, err := os.OpenFile("kd6cmd.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-				if err != nil {
-					return "", fmt.Errorf("cannot write to log file: %v", err)
-				}
-				defer f_log.Close()
-				if _, err := f_log.WriteString(dt_string_rec + "\n"); err != nil {
-					log.Println(err)
-				}
-				if _, err := f_log.WriteString("received: " + result + "\n\n"); err != nil {
-					log.Println(err)
-				}
-			}
+	// throw away any stale replies, for example to a command that timed out
+	if err := drainStale(t); err != nil {
+		return "", err
+	}
 
-			if cis.Logging {
-				fmt.Printf("%s\n", dt_string_rec)
-				fmt.Printf("received: %s\n\n", result)
+	sent := time.Now()
+	if err := t.WriteCommand([]byte(write_string)); err != nil {
+		return "", err
+	}
 
-			}
-			return result, nil
-		case n == 0:
-			return "", fmt.Errorf("no data in result from command")
-		case time.Since(start) > time.Second*10:
-			return "", fmt.Errorf("timeout receiving result from command")
+	result, err := cis.readReply(ctx, t)
+	roundTrip = time.Since(sent)
+	if err != nil {
+		// the reply may still arrive, after the next command is written
+		markStale(t)
+		return "", err
+	}
+
+	if err := checkStatus(cmd, params, result); err != nil {
+		if errors.Is(err, ErrInvalidReply) {
+			markStale(t)
+		}
+		return result, err
+	}
+	if err := checkReply(cmd, params, result); err != nil {
+		// the reply was to an earlier command, so the reply to this one
+		// is waiting to be read, or still on its way.
+		if d, ok := t.(Drainer); ok {
+			d.Drain()
 		}
+		markStale(t)
+		return result, err
 	}
+	return result, nil
 }
 
 func checkError(funcname, result string) error {
 	if len(result) < 4 {
-		return fmt.Errorf("invalid result from %s: %s", funcname, result)
+		return fmt.Errorf("invalid result from %s: %s: %w", funcname, result, ErrInvalidReply)
 	}
 
 	return nil
@@ -683,23 +770,20 @@ func (cis Sensor) ReadRegister(register string) error {
 	return cis.ReadRegisterWithVal(register, "80")
 }
 
-func parseRate(short_res string) error {
-	var val float32
+func parseRate(short_res string) (int, error) {
 	switch short_res {
 	case "00":
-		val = 9.6
+		return 9600, nil
 	case "01":
-		val = 19.2
+		return 19200, nil
 	case "02":
-		val = 115.2
+		return 115200, nil
 	default:
-		return errors.New("invalid output Baud Rate")
+		return 0, errors.New("invalid output Baud Rate")
 	}
-	fmt.Printf("(UART Setting: Baud rate: %.1f MHz)\n", val)
-	return nil
 }
 
-func parseFreq(short_res string) error {
+func parseFreq(short_res string) (float32, error) {
 	var val float32
 	switch short_res {
 	case "00":
@@ -731,7 +815,7 @@ func parseFreq(short_res string) error {
 	case "0D":
 		val = 60.0
 	case "0E":
-		val = 62.7
+		val = 61.7
 	case "0F":
 		val = 62.4
 	case "10":
@@ -761,333 +845,241 @@ func parseFreq(short_res string) error {
 	case "1C":
 		val = 84.0
 	default:
-		return errors.New("invalid output frequency")
+		return 0, errors.New("invalid output frequency")
 	}
-	fmt.Printf("(Frequency: %.1f MHz)\n", val)
-	return nil
+	return val, nil
 }
 
-func parseComm(short_res, val string) error {
-	switch val {
-	case "80":
-		var val string
-		switch short_res {
-		case "00":
-			val = "10bit Serial Base Configuration"
-		case "01":
-			val = "10bit Serial Medium Configuration"
-		case "02":
-			val = "10bit Serial Medium Configuration2"
-		case "03":
-			val = "10bit Serial Medium Configuration3"
-		case "04":
-			val = "10bit Parallel Base Configuration"
-		case "05":
-			val = "10bit Parallel Medium Configuration"
-		case "06":
-			val = "10bit Parallel Medium Configuration2"
-		case "07":
-			val = "10bit Parallel Medium Configuration3"
-		case "08":
-			val = "8bit Serial Base Configuration"
-		case "09":
-			val = "8bit Serial Medium Configuration"
-		case "0A":
-			val = "8bit Serial Medium Configuration2"
-		case "0B":
-			val = "8bit Serial Medium Configuration3"
-		case "0C":
-			val = "8bit Parallel Base Configuration"
-		case "0D":
-			val = "8bit Parallel Medium Configuration"
-		case "0E":
-			val = "8bit Parallel Medium Configuration2"
-		case "0F":
-			val = "8bit Parallel Medium Configuration3"
-		default:
-			return errors.New("invalid output format")
-		}
-		fmt.Printf("(Output Format: %s)\n", val)
-
-	case "A0":
-		var val string
-		switch short_res {
-		case "20":
-			val = "Overlap Output Off"
-		case "21":
-			val = "Overlap Output On"
-		default:
-			return errors.New("invalid overlap output")
-		}
-		fmt.Printf("(%s)\n", val)
-
-	case "C0":
-		var val string
-		switch short_res {
-		case "40":
-			val = "Interpolation function Off"
-		case "41":
-			val = "Interpolation function On"
-		default:
-			return errors.New("invalid interpolation output")
-		}
-		fmt.Printf("(%s)\n", val)
-	default:
-		return errors.New("invalid output format")
-	}
-	return nil
-}
-func parseRes(short_res string) error {
-	var val int32
-	switch short_res {
-	case "00":
-		val = 600
-	case "01":
-		val = 300
-	case "02":
-		val = 150
-	case "03":
-		val = 75
-	default:
-		return errors.New("invalid resolution")
+func parseOutputFormat(short_res string) (OutputFormat, error) {
+	code, err := strconv.ParseUint(short_res, 16, 8)
+	if err != nil || code > 0x0F {
+		return OutputFormat{}, errors.New("invalid output format")
 	}
-	fmt.Printf("(Resolution: %ddpi)\n", val)
-	return nil
-}
 
-func parseSync(short_res string) error {
-	var val string
-	switch short_res {
-	case "00":
-		val = "Internal synchronization"
-	case "01":
-		val = "External synchronization"
-	default:
-		return errors.New("invalid synchronization mode")
+	f := OutputFormat{
+		Bits:      PixelOutputBits(code >> 3),
+		Interface: PixelOutputInterface((code >> 2) & 1),
+		Config:    PixelOutputBase,
+		Number:    1,
 	}
-	fmt.Printf("(%s)\n", val)
-	return nil
-}
-
-func parseLED(short_res, result, val string) error {
-	switch val {
-	case "80":
-		var val string
-		switch short_res {
-		case "00":
-			val = "Pulse1: OFF"
-		case "01":
-			val = "Pulse1: illumination A ON"
-		case "02":
-			val = "Pulse1: illumination B ON"
-		case "03":
-			val = "Pulse1: A and B ON"
-		case "04":
-			val = "Pulse2: OFF"
-		case "05":
-			val = "Pulse2: illumination A ON"
-		case "06":
-			val = "Pulse2: illumination B ON"
-		case "07":
-			val = "Pulse2: A and B ON"
-		case "08":
-			val = "Pulse4: OFF"
-		case "09":
-			val = "Pulse4: illumination A ON"
-		case "0A":
-			val = "Pulse4: illumination B ON"
-		case "0B":
-			val = "Pulse4: A and B ON"
-		case "0C":
-			val = "Pulse8: OFF"
-		case "0D":
-			val = "Pulse8: illumination A ON"
-		case "0E":
-			val = "ulse8: illumination B ON"
-		case "0F":
-			val = "Pulse8: A and B ON"
-		default:
-			return errors.New("invalid LED config")
-		}
-		fmt.Printf("(%s)\n", val)
-
-	case "A0":
-		if len(result) < 8 {
-			fmt.Printf("(LED Period A: %d)", len(result))
-			return errors.New("result too short")
-		}
-		hex := result[4:8]
-		value, _ := strconv.ParseInt(hex, 16, 64)
-		fmt.Printf("(LED Period A: %d)\n", value)
-	case "C0":
-		if len(result) < 8 {
-			fmt.Printf("(LED Period A: %d)", len(result))
-			return errors.New("result too short")
-		}
-		hex := result[4:8]
-		value, _ := strconv.ParseInt(hex, 16, 64)
-		fmt.Printf("(LED Period B: %d)\n", value)
-	case "E0":
-		hex := result[4:8]
-		value, _ := strconv.ParseInt(hex, 16, 64)
-		fmt.Printf("(LED Illumination period setting %d)\n", value)
-	default:
-		return errors.New("LED control setting")
+	if n := int(code & 3); n > 0 {
+		f.Config = PixelOutputMedium
+		f.Number = n
 	}
-	return nil
+	return f, nil
 }
 
-func parseDarkCorr(short_res string) error {
-	var val string
+// parseSwitch decodes the reply for an on/off register setting, where base
+// is the value for off and base+1 is the value for on.
+func parseSwitch(short_res string, base int, name string) (bool, error) {
 	switch short_res {
-	case "00":
-		val = "Black correction OFF"
-	case "01":
-		val = "Black correction ON"
+	case fmt.Sprintf("%02X", base):
+		return false, nil
+	case fmt.Sprintf("%02X", base+1):
+		return true, nil
 	default:
-		return errors.New("invalid dark correction mode")
+		return false, fmt.Errorf("invalid %s", name)
 	}
-	fmt.Printf("(%s)\n", val)
-	return nil
 }
 
-func parseWhiteCorr(short_res string) error {
-	var val string
+func parseRes(short_res string) (int, error) {
 	switch short_res {
 	case "00":
-		val = "White correction OFF"
+		return 600, nil
 	case "01":
-		val = "White correction ON"
+		return 300, nil
+	case "02":
+		return 150, nil
+	case "03":
+		return 75, nil
 	default:
-		return errors.New("invalid white correction mode")
+		return 0, errors.New("invalid resolution")
 	}
-	fmt.Printf("(%s)\n", val)
-	return nil
 }
 
-func parseTestPattern(short_res, val string) error {
-	switch val {
-	case "80":
-		var val string
-		switch short_res {
-		case "00":
-			val = "Image output"
-		case "01":
-			val = "Test pattern output"
-		default:
-			return errors.New("output mode")
-		}
-		fmt.Printf("(%s)\n", val)
-	case "A0":
-		var val string
-		switch short_res {
-		case "20":
-			val = "Stripe pattern output"
-		case "21":
-			val = "Ramp pattern output"
-		default:
-			return errors.New("invalid test pattern")
-		}
-		fmt.Printf("(%s)\n", val)
-	default:
-		return errors.New("Test Pattern")
-
+// parseLEDControl decodes the LC register into the LEDs that are on,
+// and the pulse divider.
+func parseLEDControl(short_res string) (string, int, error) {
+	val, err := strconv.ParseUint(short_res, 16, 8)
+	if err != nil || val > 0x0F {
+		return "", 0, errors.New("invalid LED config")
 	}
 
-	return nil
+	var leds string
+	switch val & 3 {
+	case 1:
+		leds = "A"
+	case 2:
+		leds = "B"
+	case 3:
+		leds = "AB"
+	}
+	return leds, 1 << (val >> 2), nil
 }
 
-func parsePGA(short_res, res, val string) error {
-	switch val {
-	case "80":
-		var val string
-		switch short_res {
-		case "00":
-			val = "OFF"
-		case "01":
-			val = "ON"
-		default:
-			return errors.New("parsePGA")
-		}
-		fmt.Printf("(PGA Status: %s)\n", val)
-	case "A0":
-		var val string
-		switch short_res {
-		case "20":
-			val = "+"
-		case "21":
-			val = "-"
-		default:
-			return errors.New("invalid test pattern")
-		}
-		value, _ := strconv.ParseInt(res[4:8], 16, 64)
-		fmt.Printf("(PGA Gain value: %s%d)\n", val, value)
-	default:
-		return errors.New("Test Pattern")
-
+// parseWord decodes the 16-bit value that follows the status and
+// sub-register in the reply for a register setting.
+func parseWord(result string) (int, error) {
+	if len(result) < 8 {
+		return 0, errors.New("result too short")
+	}
+	value, err := strconv.ParseUint(result[4:8], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid register value: %s", result[4:8])
 	}
+	return int(value), nil
+}
 
-	return nil
+func parseGain(short_res, result string) (int, error) {
+	negative, err := parseSwitch(short_res, 0x20, "PGA gain sign")
+	if err != nil {
+		return 0, err
+	}
+	value, err := parseWord(result)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		value = -value
+	}
+	return value, nil
 }
 
-func parseName(short_res, result, val string) error {
+// parseName returns the serial number in a reply to SI C0.
+func parseName(result string) (string, error) {
+	if len(result) < 14 {
+		return "", fmt.Errorf("reply %q too short for serial number", result)
+	}
 	prod_num_p2 := result[4:6]
 	prod_num_p1 := result[6:8]
 	id := result[8:10]
 	m := result[10:12]
 	y := result[12:14]
 
-	sn := y + m + id + prod_num_p1 + prod_num_p2
-	fmt.Printf("(SN: %s)\n", sn)
-	return nil
+	return y + m + id + prod_num_p1 + prod_num_p2, nil
 }
 
-func (cis Sensor) ReadRegisterWithVal(register, val string) error {
+// readRegister sends a read-back command for the register, and returns the
+// reply if the sensor reports success.
+func (cis Sensor) readRegister(register, val string) (string, error) {
 	result, err := cis.SendCommand(register, val)
 	if err != nil {
-		return errors.New("error: send command failed")
+		return "", err
 	}
-	fmt.Printf("Reading %s register with parameter 0x%s ", register, val)
+	if len(result) < 4 {
+		return "", &ProtocolError{Command: register, Params: val, Reply: result, Err: ErrInvalidReply}
+	}
+	return result, nil
+}
 
-	if result[:2] != "00" {
+func (cis Sensor) ReadRegisterWithVal(register, val string) error {
+	result, err := cis.SendCommand(register, val)
+	fmt.Printf("Reading %s register with parameter 0x%s ", register, val)
+	if err != nil {
 		fmt.Printf("Reading FAIL. ")
-		return errors.New("error: reading fal")
+		return err
+	}
+	if len(result) < 4 {
+		fmt.Printf("Reading FAIL. ")
+		return &ProtocolError{Command: register, Params: val, Reply: result, Err: ErrInvalidReply}
 	}
 
 	fmt.Print("Response from CIS ")
 
-	for index := 0; index < len(result); index += 2 {
+	for index := 0; index+2 <= len(result); index += 2 {
 		fmt.Printf("0x%s ", result[index:index+2])
 	}
 
+	desc, err := describeRegister(register, val, result)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("(%s)\n", desc)
+	return nil
+}
+
+// describeRegister returns a human readable description of the reply to a
+// read-back command.
+func describeRegister(register, val, result string) (string, error) {
 	short_res := result[2:4]
 
-	switch register {
-	case "BR":
-		return parseRate(short_res)
-	case "OF":
-		return parseFreq(short_res)
-	case "OC":
-		return parseComm(short_res, val)
-	case "RC":
-		return parseRes(short_res)
-	case "SS":
-		return parseSync(short_res)
-	case "LC":
-		return parseLED(short_res, result, val)
-	case "DC":
-		return parseDarkCorr(short_res)
-	case "WC":
-		return parseWhiteCorr(short_res)
-	case "TP":
-		return parseTestPattern(short_res, val)
-	case "SI":
-		return parseName(short_res, result, val)
-	case "PG":
-		return parsePGA(short_res, result, val)
+	switch register + val {
+	case "BR80":
+		baud, err := parseRate(short_res)
+		return fmt.Sprintf("UART Setting: Baud rate: %d", baud), err
+	case "OF80":
+		freq, err := parseFreq(short_res)
+		return fmt.Sprintf("Frequency: %.1f MHz", freq), err
+	case "OC80":
+		f, err := parseOutputFormat(short_res)
+		return fmt.Sprintf("Output Format: %s", f), err
+	case "OCA0":
+		on, err := parseSwitch(short_res, 0x20, "overlap output")
+		return "Overlap Output " + onOffString(on), err
+	case "OCC0":
+		on, err := parseSwitch(short_res, 0x40, "interpolation output")
+		return "Interpolation function " + onOffString(on), err
+	case "RC80":
+		res, err := parseRes(short_res)
+		return fmt.Sprintf("Resolution: %ddpi", res), err
+	case "SS80":
+		external, err := parseSwitch(short_res, 0x00, "synchronization mode")
+		if external {
+			return "External synchronization", err
+		}
+		return "Internal synchronization", err
+	case "LC80":
+		leds, pulse, err := parseLEDControl(short_res)
+		if leds == "" {
+			leds = "OFF"
+		} else {
+			leds += " ON"
+		}
+		return fmt.Sprintf("Pulse%d: illumination %s", pulse, leds), err
+	case "LCA0":
+		value, err := parseWord(result)
+		return fmt.Sprintf("LED Period A: %d", value), err
+	case "LCC0":
+		value, err := parseWord(result)
+		return fmt.Sprintf("LED Period B: %d", value), err
+	case "LCE0":
+		value, err := parseWord(result)
+		return fmt.Sprintf("LED Illumination period setting %d", value), err
+	case "DC80":
+		on, err := parseSwitch(short_res, 0x00, "dark correction mode")
+		return "Black correction " + onOffString(on), err
+	case "WC80":
+		on, err := parseSwitch(short_res, 0x00, "white correction mode")
+		return "White correction " + onOffString(on), err
+	case "TP80":
+		on, err := parseSwitch(short_res, 0x00, "output mode")
+		if on {
+			return "Test pattern output", err
+		}
+		return "Image output", err
+	case "TPA0":
+		ramp, err := parseSwitch(short_res, 0x20, "test pattern")
+		if ramp {
+			return "Ramp pattern output", err
+		}
+		return "Stripe pattern output", err
+	case "PG80":
+		on, err := parseSwitch(short_res, 0x00, "PGA status")
+		return "PGA Status: " + onOffString(on), err
+	case "PGA0":
+		gain, err := parseGain(short_res, result)
+		return fmt.Sprintf("PGA Gain value: %+d", gain), err
+	case "SIC0":
+		sn, err := parseName(result)
+		return "SN: " + sn, err
 	default:
-		fmt.Printf("(default)")
+		return "default", nil
 	}
+}
 
-	return nil
+func onOffString(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
 }
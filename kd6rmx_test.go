@@ -1,7 +1,24 @@
 package kd6rmx
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/northvolt/go-kd6rmx/sim"
 )
 
 func TestSensor(t *testing.T) {
@@ -10,3 +27,1214 @@ func TestSensor(t *testing.T) {
 		t.Error("Sensor should not have default port value")
 	}
 }
+
+type fakeTransport struct {
+	sent   []string
+	replay []string
+}
+
+func (t *fakeTransport) WriteCommand(frame []byte) error {
+	t.sent = append(t.sent, string(frame))
+	return nil
+}
+
+func (t *fakeTransport) ReadReply() (string, error) {
+	reply := t.replay[0]
+	t.replay = t.replay[1:]
+	return reply, nil
+}
+
+func (t *fakeTransport) Close() error {
+	return nil
+}
+
+func TestSensorTransport(t *testing.T) {
+	ft := &fakeTransport{replay: []string{"0000"}}
+	cis := Sensor{Transport: ft}
+	if err := cis.PixelResolution(600); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.sent) != 1 || ft.sent[0] != "RC00\r" {
+		t.Errorf("unexpected command frames sent: %q", ft.sent)
+	}
+}
+
+func TestInternalSyncRange(t *testing.T) {
+	ft := &fakeTransport{}
+	cis := Sensor{Transport: ft}
+	for _, clock := range []int{0, 0x10000} {
+		if err := cis.InternalSync(clock); err == nil {
+			t.Errorf("InternalSync(%d) succeeded", clock)
+		}
+	}
+	if len(ft.sent) != 0 {
+		t.Errorf("out of range clocks sent %q", ft.sent)
+	}
+}
+
+func TestReadRegisters(t *testing.T) {
+	cis := Sensor{Transport: sim.New().Transport()}
+
+	if err := cis.OutputFrequency(61.7); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.PixelOutputFormat(PixelOutputBits8, PixelOutputParallel, PixelOutputMedium, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.LEDControl("b", true, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.GainAmplifierLevel(-100); err != nil {
+		t.Fatal(err)
+	}
+
+	freq, err := cis.ReadOutputFrequency()
+	if err != nil || freq != 61.7 {
+		t.Errorf("ReadOutputFrequency() = %v, %v, want 61.7", freq, err)
+	}
+
+	want := OutputFormat{Bits: PixelOutputBits8, Interface: PixelOutputParallel, Config: PixelOutputMedium, Number: 2}
+	format, err := cis.ReadPixelOutputFormat()
+	if err != nil || format != want {
+		t.Errorf("ReadPixelOutputFormat() = %v, %v, want %v", format, err, want)
+	}
+
+	leds, pulse, err := cis.ReadLEDControl()
+	if err != nil || leds != "B" || pulse != 4 {
+		t.Errorf("ReadLEDControl() = %q, %d, %v, want B, 4", leds, pulse, err)
+	}
+
+	_, gain, err := cis.ReadGainAmplifier()
+	if err != nil || gain != -100 {
+		t.Errorf("ReadGainAmplifier() level = %d, %v, want -100", gain, err)
+	}
+}
+
+func TestLEDControl(t *testing.T) {
+	cis := Sensor{Transport: sim.New().Transport()}
+
+	if err := cis.LEDControl("AB", true, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.LEDControl("AB", false, 4); err != nil {
+		t.Fatal(err)
+	}
+	leds, pulse, err := cis.ReadLEDControl()
+	if err != nil || leds != "" || pulse != 4 {
+		t.Errorf("ReadLEDControl() after turning off = %q, %d, %v, want \"\", 4", leds, pulse, err)
+	}
+
+	if err := cis.LEDControl("AB", false, 3); err == nil {
+		t.Error("LEDControl() with pulse divider 3 succeeded")
+	}
+}
+
+func TestInternalSync(t *testing.T) {
+	s := sim.New()
+	cis := Sensor{Transport: s.Transport()}
+
+	for _, clock := range []int{0x12, 4000, 0xFFFF} {
+		if err := cis.InternalSync(clock); err != nil {
+			t.Errorf("InternalSync(%d): %v", clock, err)
+			continue
+		}
+		if external, got, err := cis.ReadSync(); err != nil || external || got != clock {
+			t.Errorf("ReadSync() = %v, %d, %v, want internal, %d", external, got, err, clock)
+		}
+	}
+
+	cmds := s.Commands()
+	if sent := cmds[len(cmds)-3]; sent != "SS00FFFF" {
+		t.Errorf("InternalSync(0xFFFF) sent %q, want SS00FFFF", sent)
+	}
+
+	if err := cis.InternalSync(0x10000); err == nil {
+		t.Error("InternalSync(0x10000) succeeded")
+	}
+}
+
+func TestReadOutputFrequency(t *testing.T) {
+	cis := Sensor{Transport: sim.New().Transport()}
+
+	// every frequency that can be set must read back the same
+	for _, freq := range []float32{48.0, 50.7, 51.0, 51.4, 52.0, 52.8, 53.3, 54.0, 54.9, 56.0,
+		57.0, 57.6, 58.3, 60.0, 61.7, 62.4, 64.0, 65.1, 66.0, 67.2, 68.0, 68.6, 72.0, 76.0,
+		76.8, 78.0, 80.0, 81.6, 84.0} {
+		if err := cis.OutputFrequency(freq); err != nil {
+			t.Errorf("OutputFrequency(%v): %v", freq, err)
+			continue
+		}
+		if got, err := cis.ReadOutputFrequency(); err != nil || got != freq {
+			t.Errorf("ReadOutputFrequency() = %v, %v, want %v", got, err, freq)
+		}
+	}
+}
+
+func TestGainAmplifierLevel(t *testing.T) {
+	s := sim.New()
+	cis := Sensor{Transport: s.Transport()}
+
+	for _, level := range []int{512, -1027, 0} {
+		if err := cis.GainAmplifierLevel(level); err != nil {
+			t.Errorf("GainAmplifierLevel(%d): %v", level, err)
+			continue
+		}
+		if _, got, err := cis.ReadGainAmplifier(); err != nil || got != level {
+			t.Errorf("ReadGainAmplifier() level = %d, %v, want %d", got, err, level)
+		}
+	}
+
+	if err := cis.GainAmplifierLevel(-100); err != nil {
+		t.Fatal(err)
+	}
+	cmds := s.Commands()
+	if sent := cmds[len(cmds)-1]; sent != "PG210064" {
+		t.Errorf("GainAmplifierLevel(-100) sent %q, want PG210064", sent)
+	}
+
+	for _, level := range []int{3072, -1028} {
+		if err := cis.GainAmplifierLevel(level); err == nil {
+			t.Errorf("GainAmplifierLevel(%d) succeeded", level)
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	sensor := sim.New()
+	cis := Sensor{Transport: sensor.Transport()}
+
+	s, err := cis.ReadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.PixelResolution = 150
+	s.OutputFormat = OutputFormat{Bits: PixelOutputBits10, Interface: PixelOutputSerial, Config: PixelOutputMedium, Number: 3}
+	s.InternalSyncClock = 0x1234
+	s.LEDs = ""
+	s.LEDPulseDivider = 8
+	s.LEDDutyA = 100
+	s.WhiteCorrectionTarget = 200
+	s.GainAmplifierEnabled = true
+	s.GainAmplifierLevel = 512
+	s.TestPattern = TestPatternRamp
+	if err := cis.ApplySettings(s); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cis.ReadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the white correction target is not applied, since setting it
+	// performs a white correction.
+	s.WhiteCorrectionTarget = 250
+	if got != s {
+		t.Errorf("ReadSettings() after ApplySettings\n got %+v\nwant %+v", got, s)
+	}
+	if dark, white := sensor.Corrections(); dark != 0 || white != 0 {
+		t.Errorf("ApplySettings() performed %d dark and %d white corrections", dark, white)
+	}
+}
+
+func TestApplySettingsLEDDutyOff(t *testing.T) {
+	s := sim.New()
+	r := sim.FactoryDefaults
+	r.LEDDutyB = 0
+	s.SetRegisters(r)
+	cis := Sensor{Transport: s.Transport()}
+
+	settings, err := cis.ReadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.ApplySettings(settings); err != nil {
+		t.Errorf("ApplySettings() of settings read back with LED duty B 0: %v", err)
+	}
+	if s.Registers() != r {
+		t.Errorf("registers %+v after ApplySettings, want %+v", s.Registers(), r)
+	}
+}
+
+func TestUpdateSettings(t *testing.T) {
+	s := sim.New()
+	cis := Sensor{Transport: s.Transport()}
+
+	desired, err := cis.ReadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired.PixelResolution = 300
+	desired.LEDDutyB = 1000
+	desired.WhiteCorrectionTarget = 200
+
+	changes, err := cis.UpdateSettings(desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SettingChange{
+		{Field: "PixelResolution", Old: 600, New: 300},
+		{Field: "LEDDutyB", Old: 2048, New: 1000},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("UpdateSettings() changes = %v, want %v", changes, want)
+	}
+
+	cmds := s.Commands()
+	if sent := cmds[len(cmds)-2:]; sent[0] != "RC01" || sent[1] != "LC4003E8" {
+		t.Errorf("UpdateSettings() sent %q, want only RC01 and LC4003E8", sent)
+	}
+
+	changes, err = cis.UpdateSettings(desired)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("UpdateSettings() with no changes = %v, %v", changes, err)
+	}
+	if dark, white := s.Corrections(); dark != 0 || white != 0 {
+		t.Errorf("UpdateSettings() performed %d dark and %d white corrections", dark, white)
+	}
+}
+
+func TestDecodeSettings(t *testing.T) {
+	files := map[string]string{
+		"json": `{"pixel_resolution": 300, "output_format": "8 parallel medium 2", "test_pattern": "ramp"}`,
+		"yaml": "pixel_resolution: 300\noutput_format: 8 parallel medium 2\ntest_pattern: ramp\n",
+		"toml": "pixel_resolution = 300\noutput_format = \"8 parallel medium 2\"\ntest_pattern = \"ramp\"\n",
+	}
+
+	for format, data := range files {
+		s := Settings{PixelResolution: 600, LEDs: "AB"}
+		if err := DecodeSettings([]byte(data), format, &s); err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+
+		want := Settings{
+			PixelResolution: 300,
+			OutputFormat:    OutputFormat{Bits: PixelOutputBits8, Interface: PixelOutputParallel, Config: PixelOutputMedium, Number: 2},
+			LEDs:            "AB",
+			TestPattern:     TestPatternRamp,
+		}
+		if s != want {
+			t.Errorf("%s: decoded %+v, want %+v", format, s, want)
+		}
+	}
+
+	var s Settings
+	if err := DecodeSettings([]byte(`{"unknown": 1}`), "json", &s); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	cis := Sensor{Transport: sim.New().Transport()}
+
+	_, err := cis.SendCommand("OF", "1D")
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("SendCommand(OF, 1D) error = %v, want ErrInvalidParameter", err)
+	}
+
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		t.Fatalf("SendCommand(OF, 1D) error is not a *ProtocolError: %v", err)
+	}
+	if perr.Command != "OF" || perr.Params != "1D" || perr.Status() != "02" {
+		t.Errorf("unexpected ProtocolError %+v", perr)
+	}
+
+	if err := cis.CommunicationSpeed(9600); err != nil {
+		t.Error(err)
+	}
+	if _, err := cis.SendCommand("ZZ", "00"); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("SendCommand(ZZ, 00) error = %v, want ErrInvalidCommand", err)
+	}
+}
+
+func TestStaleReply(t *testing.T) {
+	ft := &fakeTransport{replay: []string{"0001", "0000"}}
+	cis := Sensor{Transport: ft}
+	if err := cis.PixelResolution(600); !errors.Is(err, ErrReplyMismatch) {
+		t.Errorf("PixelResolution() with stale reply error = %v, want ErrReplyMismatch", err)
+	}
+
+	// the reply to the command is drained along with the stale one, so
+	// that the next command gets its own reply.
+	st := sim.New().Transport()
+	cis = Sensor{Transport: st}
+	if err := st.WriteCommand([]byte("RC01\r")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.PixelResolution(150); !errors.Is(err, ErrReplyMismatch) {
+		t.Errorf("PixelResolution() with stale reply error = %v, want ErrReplyMismatch", err)
+	}
+	if err := cis.PixelResolution(150); err != nil {
+		t.Errorf("PixelResolution() after draining stale reply: %v", err)
+	}
+	if _, err := cis.SendCommand("LC", "A0"); err != nil {
+		t.Errorf("read-back of LED duty A: %v", err)
+	}
+}
+
+// drainTransport counts how often it is drained.
+type drainTransport struct {
+	fakeTransport
+	drains int
+}
+
+func (t *drainTransport) Drain() error {
+	t.drains++
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	dt := &drainTransport{fakeTransport: fakeTransport{replay: []string{"0000", "0000", "0002", "0001", "0000", "0000"}}}
+	conn := NewConn(dt)
+	defer conn.Close()
+
+	// a new connection is drained before its first command only
+	for i, want := range []int{1, 1} {
+		if err := conn.PixelResolution(600); err != nil {
+			t.Fatal(err)
+		}
+		if dt.drains != want {
+			t.Errorf("drained %d times after %d commands, want %d", dt.drains, i+1, want)
+		}
+	}
+
+	// a mismatched reply is drained right away, and again before the next
+	// command, in case the reply had not arrived yet.
+	if err := conn.PixelResolution(150); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.PixelResolution(150); !errors.Is(err, ErrReplyMismatch) {
+		t.Fatalf("PixelResolution() with stale reply error = %v, want ErrReplyMismatch", err)
+	}
+	if dt.drains != 2 {
+		t.Errorf("drained %d times after a mismatched reply, want 2", dt.drains)
+	}
+	for _, want := range []int{3, 3} {
+		if err := conn.PixelResolution(600); err != nil {
+			t.Fatal(err)
+		}
+		if dt.drains != want {
+			t.Errorf("drained %d times, want %d", dt.drains, want)
+		}
+	}
+}
+
+// silentTransport never replies, but honours read deadlines.
+type silentTransport struct {
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (t *silentTransport) WriteCommand(frame []byte) error {
+	return nil
+}
+
+func (t *silentTransport) ReadReply() (string, error) {
+	for {
+		t.mu.Lock()
+		d := t.deadline
+		t.mu.Unlock()
+		if !d.IsZero() && time.Now().After(d) {
+			return "", ErrTimeout
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *silentTransport) SetReadDeadline(d time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deadline = d
+	return nil
+}
+
+func (t *silentTransport) Close() error {
+	return nil
+}
+
+func TestTimeout(t *testing.T) {
+	cis := Sensor{Transport: &silentTransport{}, Timeout: 10 * time.Millisecond}
+	if err := cis.PixelResolution(600); !errors.Is(err, ErrTimeout) {
+		t.Errorf("PixelResolution() error = %v, want ErrTimeout", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	cis = Sensor{Transport: &silentTransport{}}
+	start := time.Now()
+	if err := cis.WithContext(ctx).PixelResolution(600); err != context.Canceled {
+		t.Errorf("PixelResolution() error = %v, want context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("cancelling the context did not interrupt waiting for the reply")
+	}
+}
+
+func TestConn(t *testing.T) {
+	conn := NewConn(sim.New().Transport())
+	if err := conn.PixelResolution(300); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := conn.Sensor.ReadPixelResolution(); err != nil || res != 300 {
+		t.Errorf("ReadPixelResolution() = %d, %v, want 300", res, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.PixelResolution(600); err == nil {
+		t.Error("expected error using closed connection")
+	}
+
+	if _, err := Open("/nonexistent/port"); err == nil {
+		t.Error("expected error opening nonexistent port")
+	}
+}
+
+func TestConnConcurrent(t *testing.T) {
+	conn := NewConn(sim.New().Transport())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := conn.ReadPixelResolution()
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- conn.Do(func(cis Sensor) error {
+				if err := cis.LEDDutyCycle("A", 100); err != nil {
+					return err
+				}
+				_, err := cis.ReadLEDDutyCycle("A")
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// baudTransport is a simulated serial line, where commands only reach the
+// sensor if the host baud rate matches the sensor's.
+type baudTransport struct {
+	*sim.Transport
+	s    *sim.Sensor
+	baud int
+}
+
+func (t *baudTransport) WriteCommand(frame []byte) error {
+	codes := map[int]int{9600: 0x00, 19200: 0x01, 115200: 0x02}
+	if codes[t.baud] != t.s.Registers().BaudRate {
+		return nil
+	}
+	return t.Transport.WriteCommand(frame)
+}
+
+func (t *baudTransport) SetBaudRate(baud int) error {
+	t.baud = baud
+	return nil
+}
+
+func TestCommunicationSpeed(t *testing.T) {
+	s := sim.New()
+	bt := &baudTransport{Transport: s.Transport(), s: s, baud: 9600}
+	cis := Sensor{Transport: bt}
+
+	if err := cis.CommunicationSpeed(115200); err != nil {
+		t.Fatal(err)
+	}
+	if bt.baud != 115200 {
+		t.Errorf("host baud rate is %d after CommunicationSpeed(115200)", bt.baud)
+	}
+	if s.Registers().BaudRate != 0x02 {
+		t.Errorf("sensor BR register is %02X, want 02", s.Registers().BaudRate)
+	}
+
+	if err := cis.CommunicationSpeed(1200); err == nil {
+		t.Error("expected error for invalid baud rate")
+	}
+	if bt.baud != 115200 {
+		t.Errorf("host baud rate changed to %d by invalid CommunicationSpeed", bt.baud)
+	}
+}
+
+func TestParseSerialConfig(t *testing.T) {
+	u, err := url.Parse("serial:///dev/ttyUSB0?baud=115200&parity=even&flow=hardware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseSerialConfig(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SerialConfig{BaudRate: 115200, Parity: ParityEven, StopBits: 1, FlowControl: FlowControlHardware}
+	if c != want {
+		t.Errorf("parseSerialConfig() = %+v, want %+v", c, want)
+	}
+
+	if _, err := parseSerialConfig(url.Values{"parity": {"mark"}}); err == nil {
+		t.Error("expected error for invalid parity")
+	}
+}
+
+func TestSwitchBaudRate(t *testing.T) {
+	s := sim.New()
+	bt := &baudTransport{Transport: s.Transport(), s: s, baud: 9600}
+	conn := NewConn(bt)
+
+	if err := conn.SwitchToFastestBaudRate(); err != nil {
+		t.Fatal(err)
+	}
+	if bt.baud != 115200 || s.Registers().BaudRate != 0x02 {
+		t.Errorf("host at %d baud, sensor BR register %02X after switching to 115200", bt.baud, s.Registers().BaudRate)
+	}
+
+	// lose track of the sensor's speed, and find it again
+	bt.baud = 9600
+	baud, err := conn.ProbeBaudRate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baud != 115200 || bt.baud != 115200 {
+		t.Errorf("ProbeBaudRate() = %d, host at %d baud, want 115200", baud, bt.baud)
+	}
+}
+
+// listenSim serves the simulator on a local TCP listener, wrapping each
+// connection with wrap.
+func listenSim(t *testing.T, s *sim.Sensor, wrap func(net.Conn) io.ReadWriter) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s.Serve(wrap(conn))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// telnetConn is the server side of an RFC 2217 connection, which strips
+// Telnet commands from the data and records the baud rates set.
+type telnetConn struct {
+	net.Conn
+	r     *bufio.Reader
+	bauds chan int
+}
+
+func (c *telnetConn) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && c.r.Buffered() == 0 {
+			break
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b != telnetIAC {
+			p[n] = b
+			n++
+			continue
+		}
+
+		cmd, _ := c.r.ReadByte()
+		switch cmd {
+		case telnetIAC:
+			p[n] = b
+			n++
+		case telnetSB:
+			var sub []byte
+			for {
+				b, _ := c.r.ReadByte()
+				if b == telnetIAC {
+					if b, _ = c.r.ReadByte(); b == telnetSE {
+						break
+					}
+				}
+				sub = append(sub, b)
+			}
+			if sub[0] == telnetComPort && sub[1] == comPortSetBaudRate {
+				c.bauds <- int(binary.BigEndian.Uint32(sub[2:6]))
+			}
+			// acknowledge as a real converter would
+			c.Conn.Write(append(append([]byte{telnetIAC, telnetSB}, sub[0], sub[1]+100), telnetIAC, telnetSE))
+		default:
+			c.r.ReadByte()
+		}
+	}
+	return n, nil
+}
+
+func TestTCPTransport(t *testing.T) {
+	s := sim.New()
+	addr := listenSim(t, s, func(conn net.Conn) io.ReadWriter { return conn })
+
+	cis, err := Open("tcp://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cis.Close()
+
+	if err := cis.PixelResolution(600); err != nil {
+		t.Fatal(err)
+	}
+	res, err := cis.ReadPixelResolution()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 600 {
+		t.Errorf("ReadPixelResolution() = %d, want 600", res)
+	}
+}
+
+func TestRFC2217Transport(t *testing.T) {
+	s := sim.New()
+	bauds := make(chan int, 10)
+	addr := listenSim(t, s, func(conn net.Conn) io.ReadWriter {
+		// ask for an option the client should refuse
+		conn.Write([]byte{telnetIAC, telnetDO, telnetComPort, telnetIAC, telnetWILL, 3})
+		return &telnetConn{Conn: conn, r: bufio.NewReader(conn), bauds: bauds}
+	})
+
+	cis, err := Open("rfc2217://" + addr + "?baud=9600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cis.Close()
+
+	if baud := <-bauds; baud != 9600 {
+		t.Errorf("converter set to %d baud, want 9600", baud)
+	}
+
+	if err := cis.CommunicationSpeed(115200); err != nil {
+		t.Fatal(err)
+	}
+	if baud := <-bauds; baud != 115200 {
+		t.Errorf("converter set to %d baud, want 115200", baud)
+	}
+
+	serial, err := cis.ReadSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial == "" {
+		t.Error("ReadSerialNumber() returned an empty serial number")
+	}
+}
+
+type recordLogger struct {
+	records []string
+}
+
+func (l *recordLogger) Debug(msg string, args ...interface{}) {
+	l.records = append(l.records, fmt.Sprintln(append([]interface{}{"DEBUG", msg}, args...)...))
+}
+
+func (l *recordLogger) Error(msg string, args ...interface{}) {
+	l.records = append(l.records, fmt.Sprintln(append([]interface{}{"ERROR", msg}, args...)...))
+}
+
+func TestLogger(t *testing.T) {
+	l := &recordLogger{}
+	cis := Sensor{Port: "sim", Transport: sim.New().Transport(), Logger: l}
+
+	cis.PixelResolution(600)
+	cis.SendCommand("RC", "77")
+
+	if len(l.records) != 2 {
+		t.Fatalf("logged %d records, want 2: %q", len(l.records), l.records)
+	}
+	for i, want := range []string{
+		"DEBUG command port sim command RC params 00 reply 0000 duration ",
+		"ERROR command failed port sim command RC params 77 reply 02 duration ",
+	} {
+		if !strings.HasPrefix(l.records[i], want) {
+			t.Errorf("record %d = %q, want prefix %q", i, l.records[i], want)
+		}
+	}
+	if !strings.Contains(l.records[1], "error RC77: invalid parameter") {
+		t.Errorf("record 1 = %q, want the error", l.records[1])
+	}
+
+	var buf strings.Builder
+	NewTextLogger(&buf).Error("command failed", "port", "/dev/ttyS0", "reply", "", "error", errors.New("no reply"))
+	if got, want := buf.String()[strings.Index(buf.String(), " ")+1:], "level=ERROR msg=\"command failed\" port=/dev/ttyS0 reply=\"\" error=\"no reply\"\n"; got != want {
+		t.Errorf("TextLogger wrote %q, want %q", got, want)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewTranscriptRecorder(&buf)
+	cis := Sensor{Port: "sim", Transport: sim.New().Transport(), Observer: rec}
+
+	if err := cis.PixelResolution(300); err != nil {
+		t.Fatal(err)
+	}
+	want, err := cis.ReadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadTranscript(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := entries[0]; e.Port != "sim" || e.Command != "RC" || e.Params != "01" || e.Reply != "0001" {
+		t.Errorf("first entry %+v, want RC01 replied 0001", e)
+	}
+
+	replay := NewReplayTransport(entries)
+	cis = Sensor{Transport: replay}
+	if err := cis.PixelResolution(300); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cis.ReadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed settings %+v, want %+v", got, want)
+	}
+	if n := replay.Remaining(); n != 0 {
+		t.Errorf("%d commands left in transcript", n)
+	}
+
+	// commands that differ from the transcript are an error
+	replay = NewReplayTransport(entries)
+	if err := (Sensor{Transport: replay}).PixelResolution(600); err == nil {
+		t.Error("replaying a different command succeeded")
+	}
+
+	// timeouts are replayed as timeouts
+	replay = NewReplayTransport([]TranscriptEntry{{Command: "RC", Params: "80", Error: ErrTimeout.Error(), Timeout: true}})
+	if _, err := (Sensor{Transport: replay}).ReadPixelResolution(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("replayed timeout gave error %v, want ErrTimeout", err)
+	}
+}
+
+func TestModel(t *testing.T) {
+	s := sim.New()
+	s.ProductNumber = 0x6301
+	cis := Sensor{Transport: s.Transport()}
+
+	m, err := cis.DetectModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != GenericModel.Name || m.ProductNumber != 0x6301 {
+		t.Errorf("DetectModel() = %v, want generic model with product number 6301", m)
+	}
+
+	RegisterModel(Model{
+		Name:          "test model",
+		ProductNumber: 0x6301,
+		Chips:         1,
+		Resolutions:   []int{600, 300},
+		LEDs:          "A",
+	})
+	defer func() {
+		modelsMu.Lock()
+		delete(models, 0x6301)
+		modelsMu.Unlock()
+	}()
+
+	conn := NewConn(s.Transport())
+	if m, err := conn.DetectModel(); err != nil || m.Name != "test model" {
+		t.Fatalf("DetectModel() = %v, %v, want test model", m, err)
+	}
+
+	n := len(s.Commands())
+	for _, err := range []error{
+		conn.PixelResolution(150),
+		conn.PixelOverlap(true),
+		conn.LEDControl("AB", true, 1),
+		conn.LEDDutyCycle("B", 100),
+	} {
+		if !errors.Is(err, ErrNotSupported) {
+			t.Errorf("got error %v, want ErrNotSupported", err)
+		}
+	}
+	if len(s.Commands()) != n {
+		t.Errorf("unsupported settings sent %q", s.Commands()[n:])
+	}
+
+	for _, err := range []error{
+		conn.PixelResolution(300),
+		conn.PixelOverlap(false),
+		conn.LEDControl("A", true, 1),
+		conn.LEDControl("AB", false, 1),
+		conn.OutputFrequency(60.0),
+	} {
+		if err != nil {
+			t.Errorf("supported setting failed: %v", err)
+		}
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	s := sim.New()
+	s.SerialID = 0x07
+	s.Month = 0x11
+	cis := Sensor{Transport: s.Transport()}
+
+	info, err := cis.Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DeviceInfo{ProductNumber: 0x6201, SerialNumber: "2211076201", ID: 7, Month: 11, Year: 2022}
+	if info != want {
+		t.Errorf("Identity() = %+v, want %+v", info, want)
+	}
+
+	// short replies are an error, not a panic
+	for _, reply := range []string{"00", "0040", "00400162", "004001620107"} {
+		if _, err := parseIdentity(reply); err == nil {
+			t.Errorf("parseIdentity(%q) succeeded", reply)
+		}
+		cis := Sensor{Transport: &fakeTransport{replay: []string{reply}}}
+		if _, err := cis.Identity(); err == nil {
+			t.Errorf("Identity() with reply %q succeeded", reply)
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	s := sim.New()
+	s.SerialID = 0x42
+	addr := listenSim(t, s, func(conn net.Conn) io.ReadWriter { return conn })
+
+	// a port with nothing listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	found := Discover(context.Background(), []string{
+		"tcp://" + closed,
+		"/dev/no-such-port",
+		"tcp://" + addr,
+	})
+	if len(found) != 1 {
+		t.Fatalf("Discover() found %+v, want 1 sensor", found)
+	}
+	if d := found[0]; d.Port != "tcp://"+addr || d.BaudRate != 9600 || d.Info.ID != 0x42 {
+		t.Errorf("Discover() found %+v", d)
+	}
+
+	if got := setBaudOption("serial:///dev/ttyUSB0?parity=even", 19200); got != "serial:///dev/ttyUSB0?baud=19200&parity=even" {
+		t.Errorf("setBaudOption() = %q", got)
+	}
+}
+
+func TestPresetBackup(t *testing.T) {
+	s := sim.New()
+	cis := Sensor{Transport: s.Transport()}
+
+	// give each preset different settings
+	for _, n := range UserPresets {
+		if err := cis.LEDDutyCycle("A", 100*n); err != nil {
+			t.Fatal(err)
+		}
+		if err := cis.SaveSettings(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cis.PixelResolution(150); err != nil {
+		t.Fatal(err)
+	}
+	active := s.Registers()
+
+	b, err := cis.BackupPresets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Registers() != active {
+		t.Errorf("active registers %+v after backup, want %+v", s.Registers(), active)
+	}
+	if dark, white := s.Corrections(); dark != 0 || white != 0 {
+		t.Errorf("backup performed %d dark and %d white corrections", dark, white)
+	}
+	if len(b.Presets) != 3 || b.Sensor.ProductNumber != 0x6201 {
+		t.Fatalf("backup %+v", b)
+	}
+	for i, p := range b.Presets {
+		if p.Preset != i+1 || p.Settings.LEDDutyA != 100*(i+1) {
+			t.Errorf("preset %d has LED duty A %d, want %d", p.Preset, p.Settings.LEDDutyA, 100*(i+1))
+		}
+	}
+
+	for _, ext := range []string{".json", ".yaml", ".toml"} {
+		path := filepath.Join(t.TempDir(), "presets"+ext)
+		if err := WritePresetFile(path, b); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadPresetFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, b) {
+			t.Errorf("%s: read back %+v, want %+v", ext, got, b)
+		}
+	}
+
+	// restore onto a replacement sensor
+	r := sim.New()
+	if err := (Sensor{Transport: r.Transport()}).RestorePresets(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range UserPresets {
+		if r.Preset(n) != s.Preset(n) {
+			t.Errorf("restored preset %d is %+v, want %+v", n, r.Preset(n), s.Preset(n))
+		}
+	}
+	if r.Registers() != sim.FactoryDefaults {
+		t.Errorf("active registers %+v after restore, want factory defaults", r.Registers())
+	}
+
+	// the preset the active settings were loaded from is loaded last, to
+	// bring back its correction data, even with another white correction
+	// target than the other presets.
+	regs := s.Registers()
+	regs.WhiteTarget = 100 * 16
+	s.SetRegisters(regs)
+	if err := cis.SaveSettings(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.LoadSettings(2); err != nil {
+		t.Fatal(err)
+	}
+	active = s.Registers()
+	n := len(s.Commands())
+	if _, err := cis.BackupPresets(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Registers() != active {
+		t.Errorf("active registers %+v after backup, want %+v", s.Registers(), active)
+	}
+	var loaded string
+	for _, c := range s.Commands()[n:] {
+		if strings.HasPrefix(c, "DT") {
+			loaded = c
+		}
+	}
+	if loaded != "DT02" {
+		t.Errorf("last preset loaded by backup is %q, want DT02", loaded)
+	}
+	if dark, white := s.Corrections(); dark != 0 || white != 0 {
+		t.Errorf("backup performed %d dark and %d white corrections", dark, white)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	s := sim.New()
+	cis := Sensor{Transport: s.Transport()}
+	c := Catalog{Dir: filepath.Join(t.TempDir(), "presets")}
+
+	if recipes, err := c.List(); err != nil || len(recipes) != 0 {
+		t.Fatalf("empty catalog has %v, %v", recipes, err)
+	}
+
+	if err := cis.LEDDutyCycle("A", 1200); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.SaveSettings(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.LoadSettings(0); err != nil {
+		t.Fatal(err)
+	}
+	active := s.Registers()
+
+	settings, err := cis.ReadPreset(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.LEDDutyA != 1200 {
+		t.Errorf("preset 2 has LED duty A %d, want 1200", settings.LEDDutyA)
+	}
+	if s.Registers() != active {
+		t.Errorf("active registers %+v after reading preset, want %+v", s.Registers(), active)
+	}
+	if dark, white := s.Corrections(); dark != 0 || white != 0 {
+		t.Errorf("reading a preset performed %d dark and %d white corrections", dark, white)
+	}
+
+	// the preset the active settings were loaded from is loaded again
+	if err := cis.LEDDutyCycle("A", 900); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.SaveSettings(3); err != nil {
+		t.Fatal(err)
+	}
+	n := len(s.Commands())
+	if _, err := cis.ReadPreset(2); err != nil {
+		t.Fatal(err)
+	}
+	var loaded string
+	for _, c := range s.Commands()[n:] {
+		if strings.HasPrefix(c, "DT") {
+			loaded = c
+		}
+	}
+	if loaded != "DT03" {
+		t.Errorf("last preset loaded by reading preset 2 is %q, want DT03", loaded)
+	}
+	if dark, white := s.Corrections(); dark != 0 || white != 0 {
+		t.Errorf("reading a preset performed %d dark and %d white corrections", dark, white)
+	}
+
+	if err := c.Put(Recipe{Name: "anode-600dpi", Description: "Anode foil", Settings: settings}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(Recipe{Name: "../escape", Settings: settings}); err == nil {
+		t.Error("recipe name with a path is accepted")
+	}
+	if _, err := c.Get("separator-lowgain"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing recipe gives %v", err)
+	}
+
+	recipes, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipes) != 1 || recipes[0].Name != "anode-600dpi" || recipes[0].Description != "Anode foil" || recipes[0].Settings != settings {
+		t.Fatalf("catalog has %+v", recipes)
+	}
+
+	// push onto a replacement sensor
+	r := sim.New()
+	if err := (Sensor{Transport: r.Transport()}).PushRecipe(recipes[0], 3); err != nil {
+		t.Fatal(err)
+	}
+	if r.Preset(3) != s.Preset(2) {
+		t.Errorf("pushed preset 3 is %+v, want %+v", r.Preset(3), s.Preset(2))
+	}
+	if r.Registers() != sim.FactoryDefaults {
+		t.Errorf("active registers %+v after push, want factory defaults", r.Registers())
+	}
+	if dark, white := r.Corrections(); dark != 0 || white != 0 {
+		t.Errorf("push performed %d dark and %d white corrections", dark, white)
+	}
+
+	// settings left out of a recipe file are not pushed as zero
+	if err := os.WriteFile(filepath.Join(c.Dir, "partial.yaml"), []byte("settings:\n  pixel_resolution: 300\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("partial"); err == nil || !strings.Contains(err.Error(), "LEDDutyA") {
+		t.Errorf("partial recipe gives %v", err)
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	s := sim.New()
+	s.CorrectionTime = 150 * time.Millisecond
+	cis := Sensor{Transport: s.Transport()}
+
+	if err := cis.DarkCorrectionEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.WhiteCorrectionEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.LEDControl("B", true, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	abort := errors.New("no white reference")
+	err := cis.Calibrate(Calibration{Prepare: func(step CalibrationStep) error {
+		if step == CalibrateWhite {
+			return abort
+		}
+		return nil
+	}})
+	if !errors.Is(err, abort) {
+		t.Errorf("Calibrate() with aborted white step error = %v", err)
+	}
+	if dark, white := s.Corrections(); dark != 1 || white != 0 {
+		t.Errorf("aborted calibration performed %d dark and %d white corrections, want 1 and 0", dark, white)
+	}
+
+	var steps []CalibrationStep
+	c := Calibration{
+		Prepare: func(step CalibrationStep) error {
+			steps = append(steps, step)
+			return nil
+		},
+		LEDs:        "b",
+		WhiteTarget: 200,
+		Preset:      2,
+	}
+	n := len(s.Commands())
+	if err := cis.Calibrate(c); err != nil {
+		t.Fatal(err)
+	}
+	var loaded []string
+	for _, c := range s.Commands()[n:] {
+		switch {
+		case strings.HasPrefix(c, "DT0"):
+			loaded = append(loaded, c)
+		case strings.HasPrefix(c, "WC4") && len(loaded) > 0:
+			t.Errorf("white correction target %s sent after checking the preset", c)
+		}
+	}
+	if !reflect.DeepEqual(loaded, []string{"DT02"}) {
+		t.Errorf("presets loaded by calibration %v, want only [DT02]", loaded)
+	}
+	if !reflect.DeepEqual(steps, []CalibrationStep{CalibrateDark, CalibrateWhite}) {
+		t.Errorf("prepared steps %v", steps)
+	}
+	if dark, white := s.Corrections(); dark != 2 || white != 1 {
+		t.Errorf("performed %d dark and %d white corrections, want 2 and 1", dark, white)
+	}
+
+	r := s.Registers()
+	if !r.DarkCorrection || !r.WhiteCorrection || r.WhiteTarget != 200*16 || r.LEDControl != 0x06 {
+		t.Errorf("registers after calibration %+v", r)
+	}
+	if s.Preset(2) != r {
+		t.Errorf("preset 2 is %+v, want %+v", s.Preset(2), r)
+	}
+
+	if err := cis.Calibrate(Calibration{Preset: 4}); err == nil {
+		t.Error("Calibrate() to preset 4 succeeded")
+	}
+
+	// without a target, the correction keeps the current one.
+	if err := cis.Calibrate(Calibration{}); err != nil {
+		t.Fatal(err)
+	}
+	if dark, white := s.Corrections(); dark != 3 || white != 2 {
+		t.Errorf("performed %d dark and %d white corrections, want 3 and 2", dark, white)
+	}
+	if r := s.Registers(); r.WhiteTarget != 200*16 {
+		t.Errorf("white target %d after calibration without one, want %d", r.WhiteTarget, 200*16)
+	}
+}
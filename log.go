@@ -0,0 +1,83 @@
+package kd6rmx
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives a structured log record for every command sent to the
+// sensor. Each record has the fields port, command, params, reply, duration
+// and, for failed commands, error, given as alternating keys and values.
+//
+// The method set is a subset of that of *slog.Logger, so a *slog.Logger can
+// be used directly:
+//
+//	cis := kd6rmx.Sensor{Port: "/dev/your-port-here", Logger: slog.Default()}
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// logExchange logs a finished exchange to l.
+func logExchange(l Logger, e Exchange) {
+	args := []interface{}{
+		"port", e.Port,
+		"command", e.Command,
+		"params", e.Params,
+		"reply", e.Reply,
+		"duration", e.Duration,
+	}
+	if e.Err != nil {
+		l.Error("command failed", append(args, "error", e.Err)...)
+		return
+	}
+	l.Debug("command", args...)
+}
+
+// TextLogger is a Logger that writes each record as a line of key=value
+// pairs, for programs that do not have a logging pipeline of their own.
+type TextLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewTextLogger returns a logger that writes to w.
+func NewTextLogger(w io.Writer) *TextLogger {
+	return &TextLogger{w: w}
+}
+
+// Debug writes a record with level DEBUG.
+func (l *TextLogger) Debug(msg string, args ...interface{}) {
+	l.log("DEBUG", msg, args)
+}
+
+// Error writes a record with level ERROR.
+func (l *TextLogger) Error(msg string, args ...interface{}) {
+	l.log("ERROR", msg, args)
+}
+
+func (l *TextLogger) log(level, msg string, args []interface{}) {
+	var b strings.Builder
+	b.WriteString("time=" + time.Now().Format("2006-01-02T15:04:05.000000Z07:00"))
+	b.WriteString(" level=" + level)
+	b.WriteString(" msg=" + quote(msg))
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%s", args[i], quote(fmt.Sprint(args[i+1])))
+	}
+	b.WriteString("\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+// quote quotes s if it would otherwise not be a single value.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
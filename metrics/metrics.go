@@ -0,0 +1,186 @@
+// Package metrics exports Prometheus metrics for the communication with
+// sensors, and for their current state.
+//
+// A Metrics is both a kd6rmx.Observer, which counts the commands sent by the
+// sensors it is set on, and a prometheus.Collector:
+//
+//	m := metrics.New()
+//	prometheus.MustRegister(m)
+//
+//	cis := kd6rmx.Sensor{Port: "/dev/your-port-here", Observer: m}
+//
+// The gauges for the sensor's state are updated by Update, which reads the
+// registers back from the sensor, for example at a regular interval.
+package metrics
+
+import (
+	"errors"
+
+	"github.com/northvolt/go-kd6rmx"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "kd6rmx"
+
+// Metrics holds the metrics of one or more sensors, labelled by their port.
+type Metrics struct {
+	commands       *prometheus.CounterVec
+	latency        *prometheus.HistogramVec
+	timeouts       *prometheus.CounterVec
+	protocolErrors *prometheus.CounterVec
+
+	ledDuty         *prometheus.GaugeVec
+	ledPeriod       *prometheus.GaugeVec
+	gainEnabled     *prometheus.GaugeVec
+	gainLevel       *prometheus.GaugeVec
+	resolution      *prometheus.GaugeVec
+	outputFrequency *prometheus.GaugeVec
+}
+
+// New returns a new set of metrics.
+func New() *Metrics {
+	return &Metrics{
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "commands_total",
+			Help:      "Number of commands sent to the sensor, by register mnemonic.",
+		}, []string{"port", "command"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "reply_duration_seconds",
+			Help:      "Time from writing a command until its reply was read, not including opening the port.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"port", "command"}),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "timeouts_total",
+			Help:      "Number of commands the sensor did not reply to in time.",
+		}, []string{"port", "command"}),
+		protocolErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "protocol_errors_total",
+			Help:      "Number of commands rejected by the sensor or with a mismatched reply, by status code.",
+		}, []string{"port", "command", "status"}),
+
+		ledDuty: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "led_duty",
+			Help:      "LED duty register value, 0 to 4095.",
+		}, []string{"port", "led"}),
+		ledPeriod: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "led_illumination_period",
+			Help:      "Effective LED illumination period register value, 0 to 4095.",
+		}, []string{"port"}),
+		gainEnabled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "gain_amplifier_enabled",
+			Help:      "Whether the programmable gain amplifier is enabled.",
+		}, []string{"port"}),
+		gainLevel: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "gain_amplifier_level",
+			Help:      "Programmable gain amplifier level.",
+		}, []string{"port"}),
+		resolution: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pixel_resolution_dpi",
+			Help:      "Pixel resolution in dpi.",
+		}, []string{"port"}),
+		outputFrequency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "output_frequency_megahertz",
+			Help:      "Output frequency in MHz.",
+		}, []string{"port"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.commands, m.latency, m.timeouts, m.protocolErrors,
+		m.ledDuty, m.ledPeriod, m.gainEnabled, m.gainLevel, m.resolution, m.outputFrequency,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// ObserveExchange implements kd6rmx.Observer.
+func (m *Metrics) ObserveExchange(e kd6rmx.Exchange) {
+	cmd := mnemonic(e.Command)
+	m.commands.WithLabelValues(e.Port, cmd).Inc()
+
+	var perr *kd6rmx.ProtocolError
+	switch {
+	case e.Err == nil:
+		m.latency.WithLabelValues(e.Port, cmd).Observe(e.RoundTrip.Seconds())
+	case errors.Is(e.Err, kd6rmx.ErrTimeout):
+		m.timeouts.WithLabelValues(e.Port, cmd).Inc()
+	case errors.As(e.Err, &perr):
+		// the sensor did reply, even if it rejected the command
+		m.latency.WithLabelValues(e.Port, cmd).Observe(e.RoundTrip.Seconds())
+		m.protocolErrors.WithLabelValues(e.Port, cmd, perr.Status()).Inc()
+	}
+}
+
+// mnemonic returns the two letter register mnemonic of cmd. Some commands,
+// such as WC40 for the white correction target, start with part of their
+// parameter, which would otherwise give a label value per parameter.
+func mnemonic(cmd string) string {
+	if len(cmd) < 2 {
+		return cmd
+	}
+	return cmd[:2]
+}
+
+// Update reads the current state of the sensor, and updates the gauges for
+// its port. Gauges are updated for the registers that could be read, even
+// if reading others fails; the last error is returned.
+func (m *Metrics) Update(cis kd6rmx.Sensor) error {
+	var lastErr error
+	set := func(g prometheus.Gauge, v float64, err error) {
+		if err != nil {
+			lastErr = err
+			return
+		}
+		g.Set(v)
+	}
+
+	for _, led := range []string{"A", "B"} {
+		duty, err := cis.ReadLEDDutyCycle(led)
+		set(m.ledDuty.WithLabelValues(cis.Port, led), float64(duty), err)
+	}
+
+	period, err := cis.ReadLEDIlluminationPeriod()
+	set(m.ledPeriod.WithLabelValues(cis.Port), float64(period), err)
+
+	enabled, level, err := cis.ReadGainAmplifier()
+	set(m.gainEnabled.WithLabelValues(cis.Port), boolValue(enabled), err)
+	set(m.gainLevel.WithLabelValues(cis.Port), float64(level), err)
+
+	res, err := cis.ReadPixelResolution()
+	set(m.resolution.WithLabelValues(cis.Port), float64(res), err)
+
+	freq, err := cis.ReadOutputFrequency()
+	set(m.outputFrequency.WithLabelValues(cis.Port), float64(freq), err)
+
+	return lastErr
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
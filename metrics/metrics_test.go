@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/northvolt/go-kd6rmx"
+	"github.com/northvolt/go-kd6rmx/sim"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	s := sim.New()
+	cis := kd6rmx.Sensor{Port: "sim", Transport: s.Transport(), Observer: m}
+
+	if err := cis.PixelResolution(300); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.GainAmplifierLevel(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cis.SendCommand("RC", "77"); err == nil {
+		t.Fatal("invalid RC parameter was accepted")
+	}
+	for _, target := range []string{"0C80", "0640"} {
+		if _, err := cis.SendCommand("WC40", target); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := testutil.ToFloat64(m.commands.WithLabelValues("sim", "RC")); n != 2 {
+		t.Errorf("RC commands = %v, want 2", n)
+	}
+	if n := testutil.ToFloat64(m.protocolErrors.WithLabelValues("sim", "RC", sim.StatusInvalidParameter)); n != 1 {
+		t.Errorf("RC protocol errors = %v, want 1", n)
+	}
+	if n := testutil.ToFloat64(m.commands.WithLabelValues("sim", "WC")); n != 2 {
+		t.Errorf("WC commands = %v, want 2", n)
+	}
+	if n := testutil.CollectAndCount(m.latency); n != 3 {
+		t.Errorf("latency histograms = %d, want 3", n)
+	}
+
+	if err := m.Update(cis); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP kd6rmx_pixel_resolution_dpi Pixel resolution in dpi.
+# TYPE kd6rmx_pixel_resolution_dpi gauge
+kd6rmx_pixel_resolution_dpi{port="sim"} 300
+# HELP kd6rmx_gain_amplifier_level Programmable gain amplifier level.
+# TYPE kd6rmx_gain_amplifier_level gauge
+kd6rmx_gain_amplifier_level{port="sim"} 4
+# HELP kd6rmx_output_frequency_megahertz Output frequency in MHz.
+# TYPE kd6rmx_output_frequency_megahertz gauge
+kd6rmx_output_frequency_megahertz{port="sim"} 60
+`
+	err := testutil.CollectAndCompare(m, strings.NewReader(expected),
+		"kd6rmx_pixel_resolution_dpi", "kd6rmx_gain_amplifier_level", "kd6rmx_output_frequency_megahertz")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,166 @@
+package kd6rmx
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Model describes what a model of the KD-MX series can do. Empty fields
+// mean the model has no restrictions beyond those of the protocol.
+type Model struct {
+	Name string
+
+	// ProductNumber is the product number reported by the SI register.
+	ProductNumber int
+
+	// Chips is the number of sensor chips, which must be 2 or more for
+	// PixelOverlap to be turned on.
+	Chips int
+
+	// ActiveWidth is the width of the read area in mm.
+	ActiveWidth float64
+
+	Resolutions       []int
+	OutputFrequencies []float32
+	OutputFormats     []OutputFormat
+
+	// LEDs are the LED channels of the model, for example "AB".
+	LEDs string
+}
+
+// GenericModel is used for sensors whose product number has not been
+// registered. It allows everything the protocol allows.
+var GenericModel = Model{Name: "KD-MX"}
+
+var (
+	modelsMu sync.RWMutex
+	models   = map[int]Model{}
+)
+
+// RegisterModel adds m to the models known by DetectModel, replacing any
+// model with the same product number.
+func RegisterModel(m Model) {
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	models[m.ProductNumber] = m
+}
+
+// LookupModel returns the registered model with the product number.
+func LookupModel(productNumber int) (Model, bool) {
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+	m, ok := models[productNumber]
+	return m, ok
+}
+
+// DetectModel reads the product number of the sensor, and returns its
+// registered model. If the product number has not been registered, a copy
+// of GenericModel with the product number is returned.
+//
+// Setting the Model of a sensor makes the setters reject settings the model
+// cannot do, before sending anything to the sensor:
+//
+//	m, err := cis.DetectModel()
+//	if err != nil {
+//		return err
+//	}
+//	cis.Model = &m
+func (cis Sensor) DetectModel() (Model, error) {
+	info, err := cis.Identity()
+	if err != nil {
+		return Model{}, err
+	}
+	if m, ok := LookupModel(info.ProductNumber); ok {
+		return m, nil
+	}
+	m := GenericModel
+	m.ProductNumber = info.ProductNumber
+	return m, nil
+}
+
+// DetectModel detects the model of the sensor as for Sensor.DetectModel,
+// and sets it as the Model of the connection. It must be called before the
+// connection is shared with other goroutines.
+func (c *Conn) DetectModel() (Model, error) {
+	m, err := c.Sensor.DetectModel()
+	if err != nil {
+		return Model{}, err
+	}
+	c.Model = &m
+	return m, nil
+}
+
+// String returns the name and product number of the model.
+func (m Model) String() string {
+	return fmt.Sprintf("%s (product number %04X)", m.Name, m.ProductNumber)
+}
+
+// SupportsResolution reports whether the model supports the resolution in dpi.
+func (m Model) SupportsResolution(res int) bool {
+	if len(m.Resolutions) == 0 {
+		return true
+	}
+	for _, r := range m.Resolutions {
+		if r == res {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsOutputFrequency reports whether the model supports the output
+// frequency in MHz.
+func (m Model) SupportsOutputFrequency(freq float32) bool {
+	if len(m.OutputFrequencies) == 0 {
+		return true
+	}
+	for _, f := range m.OutputFrequencies {
+		if f == freq {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsOutputFormat reports whether the model supports the output format.
+func (m Model) SupportsOutputFormat(format OutputFormat) bool {
+	if len(m.OutputFormats) == 0 {
+		return true
+	}
+	for _, f := range m.OutputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsOverlap reports whether the model has enough sensor chips for
+// pixel overlap.
+func (m Model) SupportsOverlap() bool {
+	return m.Chips == 0 || m.Chips >= 2
+}
+
+// SupportsLEDs reports whether the model has all of the LED channels in
+// leds, for example "AB".
+func (m Model) SupportsLEDs(leds string) bool {
+	if m.LEDs == "" {
+		return true
+	}
+	for _, led := range strings.ToUpper(leds) {
+		if !strings.ContainsRune(strings.ToUpper(m.LEDs), led) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkModel returns an error wrapping ErrNotSupported if the sensor has a
+// Model, and supported returns false for it.
+func (cis Sensor) checkModel(supported func(m Model) bool, format string, a ...interface{}) error {
+	if cis.Model == nil || supported(*cis.Model) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w by %s", fmt.Sprintf(format, a...), ErrNotSupported, cis.Model.Name)
+}
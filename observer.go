@@ -0,0 +1,48 @@
+package kd6rmx
+
+import "time"
+
+// Exchange is a single command sent to the sensor, and its outcome.
+type Exchange struct {
+	Port    string
+	Command string
+	Params  string
+
+	// Reply is the reply from the sensor, if one was received.
+	Reply string
+
+	// Start is when SendCommand was called, and Duration how long it took
+	// until the reply was received, or the exchange failed, including
+	// opening the port.
+	Start    time.Time
+	Duration time.Duration
+
+	// RoundTrip is how long it took from writing the command until the
+	// reply was read, or reading it failed. Unlike Duration, it does not
+	// include opening the port or draining stale input. It is zero if the
+	// command was never written.
+	RoundTrip time.Duration
+
+	// Err is the error returned by SendCommand, if any.
+	Err error
+}
+
+// Observer is notified of every command sent by a Sensor, for example to
+// collect metrics. ObserveExchange is called after the exchange has
+// finished, and may be called from several goroutines at once.
+type Observer interface {
+	ObserveExchange(e Exchange)
+}
+
+// MultiObserver returns an Observer that notifies each of observers in turn.
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+type multiObserver []Observer
+
+func (m multiObserver) ObserveExchange(e Exchange) {
+	for _, o := range m {
+		o.ObserveExchange(e)
+	}
+}
@@ -0,0 +1,191 @@
+package kd6rmx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// UserPresets are the numbers of the presets that settings can be saved to.
+// Preset 0 holds the factory defaults.
+var UserPresets = []int{1, 2, 3}
+
+// PresetBackup holds the contents of the user presets of a sensor.
+type PresetBackup struct {
+	// Sensor is the sensor the presets were read from.
+	Sensor  DeviceInfo       `json:"sensor" yaml:"sensor" toml:"sensor"`
+	Presets []PresetSettings `json:"presets" yaml:"presets" toml:"presets"`
+}
+
+// PresetSettings are the settings stored in a single preset.
+type PresetSettings struct {
+	Preset   int      `json:"preset" yaml:"preset" toml:"preset"`
+	Settings Settings `json:"settings" yaml:"settings" toml:"settings"`
+}
+
+// BackupPresets reads the contents of each of UserPresets, by loading it
+// and reading back the settings. Loading a preset replaces the sensor's
+// correction data along with its settings, so afterwards the preset the
+// active settings were loaded from is loaded again, to bring back its
+// correction data, and the active settings are restored on top. This is also
+// done if reading a preset fails.
+//
+// If the active settings do not match any of the presets, the sensor is left
+// with the correction data of one of them. Its white correction target is
+// only brought back if one of them has the same target, since setting the
+// target performs a white correction.
+//
+// Nothing else should use the sensor while backing up, for example by
+// calling BackupPresets inside Conn.Do.
+func (cis Sensor) BackupPresets() (PresetBackup, error) {
+	info, err := cis.Identity()
+	if err != nil {
+		return PresetBackup{}, err
+	}
+	active, err := cis.ReadSettings()
+	if err != nil {
+		return PresetBackup{}, err
+	}
+
+	b := PresetBackup{Sensor: info}
+	for _, n := range UserPresets {
+		s, err := cis.readPreset(n)
+		if err != nil {
+			return PresetBackup{}, cis.reloadActive(active, b.Presets, fmt.Errorf("reading preset %d: %w", n, err))
+		}
+		b.Presets = append(b.Presets, PresetSettings{Preset: n, Settings: s})
+	}
+	return b, cis.reloadActive(active, b.Presets, nil)
+}
+
+// RestorePresets writes the presets in b to the sensor, which does not have
+// to be the one they were backed up from, by applying the settings of each
+// and saving them. The active settings of the sensor are restored
+// afterwards, also if writing a preset fails.
+//
+// The presets are saved with the sensor's current white correction target
+// and correction data, since setting the target performs a white
+// correction.
+//
+// Presets with a different CommunicationSpeed can only be restored if the
+// sensor's Transport is a BaudRateSetter. Nothing else should use the
+// sensor while restoring, as for BackupPresets.
+func (cis Sensor) RestorePresets(b PresetBackup) error {
+	for _, p := range b.Presets {
+		if !isUserPreset(p.Preset) {
+			return fmt.Errorf("invalid preset %d, must be one of %v", p.Preset, UserPresets)
+		}
+	}
+
+	active, err := cis.ReadSettings()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range b.Presets {
+		if _, err := cis.UpdateSettings(p.Settings); err != nil {
+			return cis.restoreActive(active, fmt.Errorf("writing preset %d: %w", p.Preset, err))
+		}
+		if err := cis.SaveSettings(p.Preset); err != nil {
+			return cis.restoreActive(active, fmt.Errorf("writing preset %d: %w", p.Preset, err))
+		}
+	}
+	return cis.restoreActive(active, nil)
+}
+
+// readPreset loads preset n and reads back its settings.
+func (cis Sensor) readPreset(n int) (Settings, error) {
+	if err := cis.LoadSettings(n); err != nil {
+		return Settings{}, err
+	}
+
+	s, err := cis.ReadSettings()
+	if errors.Is(err, ErrTimeout) {
+		// the preset may use another communication speed
+		if _, ok := cis.Transport.(BaudRateSetter); ok {
+			if _, perr := cis.ProbeBaudRate(); perr == nil {
+				s, err = cis.ReadSettings()
+			}
+		}
+	}
+	return s, err
+}
+
+// reloadActive brings back the active settings after the presets in read
+// were loaded to read them, and returns err, or the error bringing them
+// back. The preset the active settings match is loaded again, to bring back
+// its correction data. Failing that, one with the same white correction
+// target and communication speed is, and the rest of the active settings
+// are applied on top.
+func (cis Sensor) reloadActive(active Settings, read []PresetSettings, err error) error {
+	if n, ok := activePreset(active, read); ok {
+		if lerr := cis.LoadSettings(n); lerr != nil && err == nil {
+			err = fmt.Errorf("loading preset %d again: %w", n, lerr)
+		}
+	}
+	return cis.restoreActive(active, err)
+}
+
+// activePreset returns the preset in read that the active settings were
+// most likely loaded from.
+func activePreset(active Settings, read []PresetSettings) (int, bool) {
+	for _, p := range read {
+		if p.Settings == active {
+			return p.Preset, true
+		}
+	}
+	for _, p := range read {
+		if p.Settings.WhiteCorrectionTarget == active.WhiteCorrectionTarget &&
+			p.Settings.CommunicationSpeed == active.CommunicationSpeed {
+			return p.Preset, true
+		}
+	}
+	return 0, false
+}
+
+// restoreActive applies the active settings that were read before loading
+// or writing presets, and returns err, or the error restoring them. The
+// white correction target is left as it is, see ApplySettings.
+func (cis Sensor) restoreActive(active Settings, err error) error {
+	if _, rerr := cis.UpdateSettings(active); rerr != nil {
+		if err != nil {
+			return fmt.Errorf("%v, and restoring the active settings failed: %v", err, rerr)
+		}
+		return fmt.Errorf("restoring the active settings: %w", rerr)
+	}
+	return err
+}
+
+func isUserPreset(n int) bool {
+	for _, p := range UserPresets {
+		if p == n {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadPresetFile reads a preset backup from the file at path. The format of
+// the file is chosen by its extension, as for ReadSettingsFile.
+func ReadPresetFile(path string) (PresetBackup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PresetBackup{}, err
+	}
+	var b PresetBackup
+	if err := decode(data, filepath.Ext(path), &b); err != nil {
+		return PresetBackup{}, err
+	}
+	return b, nil
+}
+
+// WritePresetFile writes a preset backup to the file at path, as for
+// ReadPresetFile.
+func WritePresetFile(path string, b PresetBackup) error {
+	data, err := encode(b, filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
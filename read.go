@@ -0,0 +1,224 @@
+package kd6rmx
+
+import (
+	"errors"
+	"fmt"
+)
+
+// OutputFormat is the pixel output format of the sensor, as set by PixelOutputFormat.
+type OutputFormat struct {
+	Bits      PixelOutputBits
+	Interface PixelOutputInterface
+	Config    PixelOutputConfig
+	Number    int
+}
+
+// String returns the output format as described in the sensor manual,
+// for example "10bit Serial Medium Configuration2".
+func (f OutputFormat) String() string {
+	bits := 10
+	if f.Bits == PixelOutputBits8 {
+		bits = 8
+	}
+	intf := "Serial"
+	if f.Interface == PixelOutputParallel {
+		intf = "Parallel"
+	}
+	if f.Config == PixelOutputBase {
+		return fmt.Sprintf("%dbit %s Base Configuration", bits, intf)
+	}
+	if f.Number > 1 {
+		return fmt.Sprintf("%dbit %s Medium Configuration%d", bits, intf, f.Number)
+	}
+	return fmt.Sprintf("%dbit %s Medium Configuration", bits, intf)
+}
+
+// ReadCommunicationSpeed returns the communication speed in baud.
+func (cis Sensor) ReadCommunicationSpeed() (int, error) {
+	result, err := cis.readRegister("BR", "80")
+	if err != nil {
+		return 0, err
+	}
+	return parseRate(result[2:4])
+}
+
+// ReadOutputFrequency returns the output frequency in MHz.
+func (cis Sensor) ReadOutputFrequency() (float32, error) {
+	result, err := cis.readRegister("OF", "80")
+	if err != nil {
+		return 0, err
+	}
+	return parseFreq(result[2:4])
+}
+
+// ReadPixelOutputFormat returns the output format for pixels.
+func (cis Sensor) ReadPixelOutputFormat() (OutputFormat, error) {
+	result, err := cis.readRegister("OC", "80")
+	if err != nil {
+		return OutputFormat{}, err
+	}
+	return parseOutputFormat(result[2:4])
+}
+
+// ReadPixelOverlap returns whether pixel overlap is on.
+func (cis Sensor) ReadPixelOverlap() (bool, error) {
+	result, err := cis.readRegister("OC", "A0")
+	if err != nil {
+		return false, err
+	}
+	return parseSwitch(result[2:4], 0x20, "overlap output")
+}
+
+// ReadPixelInterpolation returns whether pixel interpolation is on.
+func (cis Sensor) ReadPixelInterpolation() (bool, error) {
+	result, err := cis.readRegister("OC", "C0")
+	if err != nil {
+		return false, err
+	}
+	return parseSwitch(result[2:4], 0x40, "interpolation output")
+}
+
+// ReadPixelResolution returns the resolution in dpi.
+func (cis Sensor) ReadPixelResolution() (int, error) {
+	result, err := cis.readRegister("RC", "80")
+	if err != nil {
+		return 0, err
+	}
+	return parseRes(result[2:4])
+}
+
+// ReadSync returns whether external sync is on, and the internal sync clock
+// value used when it is not.
+func (cis Sensor) ReadSync() (external bool, clock int, err error) {
+	result, err := cis.readRegister("SS", "80")
+	if err != nil {
+		return false, 0, err
+	}
+	external, err = parseSwitch(result[2:4], 0x00, "synchronization mode")
+	if err != nil {
+		return false, 0, err
+	}
+
+	result, err = cis.readRegister("SS", "A0")
+	if err != nil {
+		return false, 0, err
+	}
+	clock, err = parseWord(result)
+	return external, clock, err
+}
+
+// ReadLEDControl returns which LEDs are on, as "A", "B", "AB", or "" if both
+// are off, and the pulse divider used for them. See LEDControl.
+func (cis Sensor) ReadLEDControl() (leds string, pulsedivider int, err error) {
+	result, err := cis.readRegister("LC", "80")
+	if err != nil {
+		return "", 0, err
+	}
+	return parseLEDControl(result[2:4])
+}
+
+// ReadLEDDutyCycle returns the raw duty cycle register value for the LED.
+func (cis Sensor) ReadLEDDutyCycle(led string) (int, error) {
+	var val string
+	switch led {
+	case "a", "A":
+		val = "A0"
+	case "b", "B":
+		val = "C0"
+	default:
+		return 0, errors.New("invalid LED for duty cycle")
+	}
+
+	result, err := cis.readRegister("LC", val)
+	if err != nil {
+		return 0, err
+	}
+	return parseWord(result)
+}
+
+// ReadLEDIlluminationPeriod returns the raw illumination period register value.
+func (cis Sensor) ReadLEDIlluminationPeriod() (int, error) {
+	result, err := cis.readRegister("LC", "E0")
+	if err != nil {
+		return 0, err
+	}
+	return parseWord(result)
+}
+
+// ReadDarkCorrectionEnabled returns whether dark correction is on.
+func (cis Sensor) ReadDarkCorrectionEnabled() (bool, error) {
+	result, err := cis.readRegister("DC", "80")
+	if err != nil {
+		return false, err
+	}
+	return parseSwitch(result[2:4], 0x00, "dark correction mode")
+}
+
+// ReadWhiteCorrectionEnabled returns whether white correction is on.
+func (cis Sensor) ReadWhiteCorrectionEnabled() (bool, error) {
+	result, err := cis.readRegister("WC", "80")
+	if err != nil {
+		return false, err
+	}
+	return parseSwitch(result[2:4], 0x00, "white correction mode")
+}
+
+// ReadWhiteCorrectionTarget returns the white correction target, in the same
+// 0-255 range as used by WhiteCorrectionTarget.
+func (cis Sensor) ReadWhiteCorrectionTarget() (int, error) {
+	result, err := cis.readRegister("WC", "C0")
+	if err != nil {
+		return 0, err
+	}
+	value, err := parseWord(result)
+	return value / 16, err
+}
+
+// ReadGainAmplifier returns whether the programmable gain amplifier is on,
+// and its gain level.
+func (cis Sensor) ReadGainAmplifier() (enabled bool, level int, err error) {
+	result, err := cis.readRegister("PG", "80")
+	if err != nil {
+		return false, 0, err
+	}
+	enabled, err = parseSwitch(result[2:4], 0x00, "PGA status")
+	if err != nil {
+		return false, 0, err
+	}
+
+	result, err = cis.readRegister("PG", "A0")
+	if err != nil {
+		return false, 0, err
+	}
+	level, err = parseGain(result[2:4], result)
+	return enabled, level, err
+}
+
+// ReadTestPatternEnabled returns whether the test pattern is output instead of the image.
+func (cis Sensor) ReadTestPatternEnabled() (bool, error) {
+	result, err := cis.readRegister("TP", "80")
+	if err != nil {
+		return false, err
+	}
+	return parseSwitch(result[2:4], 0x00, "output mode")
+}
+
+// ReadTestPattern returns the selected test pattern.
+func (cis Sensor) ReadTestPattern() (TestPatternType, error) {
+	result, err := cis.readRegister("TP", "A0")
+	if err != nil {
+		return TestPatternStripe, err
+	}
+	ramp, err := parseSwitch(result[2:4], 0x20, "test pattern")
+	if ramp {
+		return TestPatternRamp, err
+	}
+	return TestPatternStripe, err
+}
+
+// ReadSerialNumber returns the serial number of the sensor. See Identity
+// for the rest of what the sensor reports about itself.
+func (cis Sensor) ReadSerialNumber() (string, error) {
+	info, err := cis.Identity()
+	return info.SerialNumber, err
+}
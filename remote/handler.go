@@ -0,0 +1,398 @@
+// Package remote gives access to sensors over HTTP/JSON, for example from a
+// web HMI on another machine than the one the sensors are attached to.
+//
+// A Handler serves the sensors it is given. The API is:
+//
+//	GET   /sensors                                list the names of the sensors
+//	GET   /sensors/{name}/settings                read all settings
+//	PATCH /sensors/{name}/settings                change the settings in the body
+//	GET   /sensors/{name}/settings/{field}        read a single setting
+//	PUT   /sensors/{name}/settings/{field}        change a single setting
+//	GET   /sensors/{name}/serial                  read the serial number
+//	GET   /sensors/{name}/identity                read the product number, serial number and manufacturing date
+//	GET   /sensors/{name}/presets                 back up the user presets
+//	PUT   /sensors/{name}/presets                 restore the user presets in the body
+//	POST  /sensors/{name}/presets/{n}/load        load user preset n
+//	POST  /sensors/{name}/presets/{n}/save        save the settings to user preset n
+//	POST  /sensors/{name}/dark-correction         perform dark correction
+//	POST  /sensors/{name}/white-correction        perform white correction
+//	POST  /sensors/{name}/reset                   perform a software reset
+//	POST  /sensors/{name}/command                 send a single raw command
+//
+// Settings and fields use the same names as settings files, for example
+// "pixel_resolution". Changing settings replies with the list of changes
+// made. White correction takes an optional {"target": n} body, which sets
+// the white correction target before correcting. The target cannot be
+// changed through the settings, since changing it performs a white
+// correction.
+//
+// Errors are replied as {"error": "..."}, with status 404 for unknown
+// sensors, 400 for invalid requests and settings the sensor's model cannot
+// do, 502 when the sensor rejects a command
+// and 504 when it does not reply.
+//
+// The handler does no authentication. Anyone who can reach it can send raw
+// commands to the sensors and reset them, so serve it only on trusted
+// networks, or behind something that authenticates.
+//
+// Transport uses the command endpoint to act as a kd6rmx.Transport, so that
+// everything in kd6rmx can be used on a remote sensor.
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/northvolt/go-kd6rmx"
+)
+
+// Handler serves a set of sensors over HTTP/JSON.
+type Handler struct {
+	sensors map[string]*kd6rmx.Conn
+}
+
+// NewHandler returns a handler that serves the given sensors by name.
+// The connections must stay open while the handler is in use.
+func NewHandler(sensors map[string]*kd6rmx.Conn) *Handler {
+	return &Handler{sensors: sensors}
+}
+
+// Command is the body of a request to the command endpoint.
+type Command struct {
+	Command string `json:"command"`
+	Params  string `json:"params"`
+}
+
+// Reply is the body of a reply from the command endpoint. Error is set if
+// the sensor rejected the command.
+type Reply struct {
+	Reply string `json:"reply"`
+	Error string `json:"error,omitempty"`
+}
+
+// errBadRequest marks errors caused by the request rather than the sensor.
+var errBadRequest = errors.New("bad request")
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if path[0] != "sensors" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(path) == 1 {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		names := make([]string, 0, len(h.sensors))
+		for name := range h.sensors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, names)
+		return
+	}
+
+	conn, ok := h.sensors[path[1]]
+	if !ok || len(path) < 3 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no sensor %q", path[1]))
+		return
+	}
+	cis := conn.WithContext(r.Context())
+
+	var (
+		result interface{}
+		err    error
+	)
+	switch {
+	case path[2] == "settings" && len(path) == 3:
+		if !allowMethod(w, r, http.MethodGet, http.MethodPatch) {
+			return
+		}
+		result, err = settings(conn, r)
+	case path[2] == "settings" && len(path) == 4:
+		if !allowMethod(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		result, err = setting(conn, r, path[3])
+	case path[2] == "serial" && len(path) == 3:
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		result, err = cis.ReadSerialNumber()
+	case path[2] == "identity" && len(path) == 3:
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		result, err = cis.Identity()
+	case path[2] == "presets" && len(path) == 3:
+		if !allowMethod(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		result, err = presets(conn, r)
+	case path[2] == "presets" && len(path) == 5:
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = preset(cis, path[3], path[4])
+	case path[2] == "dark-correction" && len(path) == 3:
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = cis.PerformDarkCorrection()
+	case path[2] == "white-correction" && len(path) == 3:
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = whiteCorrection(cis, r)
+	case path[2] == "reset" && len(path) == 3:
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = cis.SoftwareReset()
+	case path[2] == "command" && len(path) == 3:
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		command(w, conn, cis, r)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// settings reads the settings, or applies the settings in the body on top
+// of the current ones, without other commands sent to the sensor in between.
+func settings(conn *kd6rmx.Conn, r *http.Request) (interface{}, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	err = conn.Do(func(cis kd6rmx.Sensor) error {
+		cis = cis.WithContext(r.Context())
+		current, err := cis.ReadSettings()
+		if err != nil || r.Method == http.MethodGet {
+			result = current
+			return err
+		}
+
+		desired := current
+		if err := kd6rmx.DecodeSettings(body, "json", &desired); err != nil {
+			return fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		result, err = updateSettings(cis, current, desired)
+		return err
+	})
+	return result, err
+}
+
+// setting reads or changes a single field of the settings, without other
+// commands sent to the sensor in between.
+func setting(conn *kd6rmx.Conn, r *http.Request, field string) (interface{}, error) {
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	err = conn.Do(func(cis kd6rmx.Sensor) error {
+		cis = cis.WithContext(r.Context())
+		current, err := cis.ReadSettings()
+		if err != nil {
+			return err
+		}
+
+		if r.Method == http.MethodGet {
+			data, err := json.Marshal(current)
+			if err != nil {
+				return err
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(data, &fields); err != nil {
+				return err
+			}
+			value, ok := fields[field]
+			if !ok {
+				return fmt.Errorf("%w: unknown settings field %q", errBadRequest, field)
+			}
+			result = value
+			return nil
+		}
+
+		data, err := json.Marshal(map[string]json.RawMessage{field: value})
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		desired := current
+		if err := kd6rmx.DecodeSettings(data, "json", &desired); err != nil {
+			return fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		result, err = updateSettings(cis, current, desired)
+		return err
+	})
+	return result, err
+}
+
+func updateSettings(cis kd6rmx.Sensor, current, desired kd6rmx.Settings) ([]kd6rmx.SettingChange, error) {
+	if desired.WhiteCorrectionTarget != current.WhiteCorrectionTarget {
+		return nil, fmt.Errorf("%w: white_correction_target is changed with POST white-correction", errBadRequest)
+	}
+	changes, err := cis.UpdateSettings(desired)
+	if changes == nil {
+		changes = []kd6rmx.SettingChange{}
+	}
+	return changes, err
+}
+
+// presets backs up or restores the user presets, without other commands
+// sent to the sensor in between.
+func presets(conn *kd6rmx.Conn, r *http.Request) (interface{}, error) {
+	if r.Method == http.MethodGet {
+		var b kd6rmx.PresetBackup
+		err := conn.Do(func(cis kd6rmx.Sensor) error {
+			var err error
+			b, err = cis.WithContext(r.Context()).BackupPresets()
+			return err
+		})
+		return b, err
+	}
+
+	var b kd6rmx.PresetBackup
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&b); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil, conn.Do(func(cis kd6rmx.Sensor) error {
+		return cis.WithContext(r.Context()).RestorePresets(b)
+	})
+}
+
+func preset(cis kd6rmx.Sensor, n, action string) error {
+	preset, err := strconv.Atoi(n)
+	if err != nil {
+		return fmt.Errorf("%w: invalid preset %q", errBadRequest, n)
+	}
+
+	switch action {
+	case "load":
+		return cis.LoadSettings(preset)
+	case "save":
+		return cis.SaveSettings(preset)
+	default:
+		return fmt.Errorf("%w: invalid preset action %q, must be load or save", errBadRequest, action)
+	}
+}
+
+func whiteCorrection(cis kd6rmx.Sensor, r *http.Request) error {
+	var body struct {
+		Target *int `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+
+	if body.Target != nil {
+		return cis.WhiteCorrectionTarget(*body.Target)
+	}
+	return cis.PerformWhiteCorrection()
+}
+
+// command sends a raw command to the sensor. The reply is passed on even if
+// the sensor rejected the command, so that the client can decode the error
+// itself.
+//
+// Changes to the communication speed are made with SwitchBaudRate, so that
+// the connection to the sensor keeps working.
+func command(w http.ResponseWriter, conn *kd6rmx.Conn, cis kd6rmx.Sensor, r *http.Request) {
+	var c Command
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if c.Command == "BR" {
+		if baud, ok := baudRates[c.Params]; ok {
+			if _, ok := conn.Transport.(kd6rmx.BaudRateSetter); ok {
+				if err := conn.SwitchBaudRate(baud); err != nil {
+					writeError(w, errorStatus(err), err)
+					return
+				}
+				writeJSON(w, http.StatusOK, Reply{Reply: "00" + c.Params})
+				return
+			}
+		}
+	}
+
+	reply, err := cis.SendCommand(c.Command, c.Params)
+	var perr *kd6rmx.ProtocolError
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, Reply{Reply: reply})
+	case errors.As(err, &perr):
+		writeJSON(w, http.StatusOK, Reply{Reply: reply, Error: err.Error()})
+	default:
+		writeError(w, errorStatus(err), err)
+	}
+}
+
+// baudRates are the speeds set by the params of the BR command.
+var baudRates = map[string]int{
+	"00": 9600,
+	"01": 19200,
+	"02": 115200,
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func errorStatus(err error) int {
+	var perr *kd6rmx.ProtocolError
+	switch {
+	case errors.Is(err, errBadRequest), errors.Is(err, kd6rmx.ErrNotSupported):
+		return http.StatusBadRequest
+	case errors.Is(err, kd6rmx.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &perr):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,129 @@
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/northvolt/go-kd6rmx"
+	"github.com/northvolt/go-kd6rmx/sim"
+)
+
+func newServer(t *testing.T) (*sim.Sensor, *httptest.Server) {
+	s := sim.New()
+	srv := httptest.NewServer(NewHandler(map[string]*kd6rmx.Conn{
+		"line1": kd6rmx.NewConn(s.Transport()),
+	}))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func do(t *testing.T, method, url, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHandler(t *testing.T) {
+	s, srv := newServer(t)
+	url := srv.URL + "/sensors/line1"
+
+	var names []string
+	if code := do(t, "GET", srv.URL+"/sensors", "", &names); code != http.StatusOK || len(names) != 1 || names[0] != "line1" {
+		t.Errorf("GET /sensors = %d %v", code, names)
+	}
+
+	var settings kd6rmx.Settings
+	if code := do(t, "GET", url+"/settings", "", &settings); code != http.StatusOK {
+		t.Fatalf("GET settings = %d", code)
+	}
+	if settings.OutputFrequency != 60.0 {
+		t.Errorf("OutputFrequency = %v, want 60", settings.OutputFrequency)
+	}
+
+	var changes []map[string]interface{}
+	if code := do(t, "PUT", url+"/settings/pixel_resolution", "300", &changes); code != http.StatusOK || len(changes) != 1 {
+		t.Errorf("PUT pixel_resolution = %d %v", code, changes)
+	}
+	var res int
+	if code := do(t, "GET", url+"/settings/pixel_resolution", "", &res); code != http.StatusOK || res != 300 {
+		t.Errorf("GET pixel_resolution = %d %d, want 300", code, res)
+	}
+
+	if code := do(t, "PATCH", url+"/settings", `{"led_duty_a": 100, "gain_amplifier_level": 3}`, &changes); code != http.StatusOK || len(changes) != 2 {
+		t.Errorf("PATCH settings = %d %v", code, changes)
+	}
+	if r := s.Registers(); r.LEDDutyA != 100 || r.GainLevel != 3 {
+		t.Errorf("sensor has duty A %d, gain %d after PATCH", r.LEDDutyA, r.GainLevel)
+	}
+
+	if code := do(t, "POST", url+"/presets/2/save", "", nil); code != http.StatusNoContent {
+		t.Errorf("POST presets/2/save = %d", code)
+	}
+	if s.Preset(2).Resolution != s.Registers().Resolution {
+		t.Error("preset 2 was not saved")
+	}
+
+	var e map[string]string
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/sensors/line2/settings", "", http.StatusNotFound},
+		{"DELETE", "/sensors/line1/settings", "", http.StatusMethodNotAllowed},
+		{"GET", "/sensors/line1/settings/no_such_field", "", http.StatusBadRequest},
+		{"PATCH", "/sensors/line1/settings", `{"no_such_field": 1}`, http.StatusBadRequest},
+		{"POST", "/sensors/line1/presets/x/load", "", http.StatusBadRequest},
+		{"PUT", "/sensors/line1/settings/white_correction_target", "200", http.StatusBadRequest},
+		{"PATCH", "/sensors/line1/settings", `{"white_correction_target": 200}`, http.StatusBadRequest},
+	} {
+		if code := do(t, tc.method, srv.URL+tc.path, tc.body, &e); code != tc.code || e["error"] == "" {
+			t.Errorf("%s %s = %d %v, want %d", tc.method, tc.path, code, e, tc.code)
+		}
+	}
+	if dark, white := s.Corrections(); dark != 0 || white != 0 {
+		t.Errorf("settings performed %d dark and %d white corrections", dark, white)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	s, srv := newServer(t)
+	cis := kd6rmx.Sensor{Transport: NewTransport(srv.URL + "/sensors/line1/")}
+
+	if err := cis.PixelResolution(300); err != nil {
+		t.Fatal(err)
+	}
+	if s.Registers().Resolution != 0x01 {
+		t.Errorf("sensor resolution register %02X, want 01", s.Registers().Resolution)
+	}
+
+	settings, err := cis.ReadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.PixelResolution != 300 {
+		t.Errorf("PixelResolution = %d, want 300", settings.PixelResolution)
+	}
+
+	// errors from the sensor are decoded on the client as usual
+	_, err = cis.SendCommand("XX", "00")
+	if !errors.Is(err, kd6rmx.ErrInvalidCommand) {
+		t.Errorf("SendCommand(XX) error %v, want ErrInvalidCommand", err)
+	}
+}
@@ -0,0 +1,122 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/northvolt/go-kd6rmx"
+)
+
+// defaultTimeout is how long to wait for the reply to a command, if no read
+// deadline has been set.
+const defaultTimeout = 30 * time.Second
+
+// Transport is a kd6rmx.Transport that sends commands to a sensor served by
+// a Handler, so that a remote sensor can be used like a local one:
+//
+//	cis := kd6rmx.Sensor{Transport: remote.NewTransport("http://hmi:8080/sensors/line1")}
+//	err := cis.PixelResolution(600)
+type Transport struct {
+	url    string
+	client *http.Client
+	frame  string
+
+	mu       sync.Mutex
+	deadline time.Time
+	cancel   context.CancelFunc
+}
+
+// NewTransport returns a transport for the sensor at url, which is the
+// address of a Handler followed by /sensors/{name}.
+func NewTransport(url string) *Transport {
+	return &Transport{url: strings.TrimSuffix(url, "/"), client: http.DefaultClient}
+}
+
+// WriteCommand stores the command frame, which is sent by ReadReply.
+func (t *Transport) WriteCommand(frame []byte) error {
+	if len(frame) < 3 || frame[len(frame)-1] != '\r' {
+		return fmt.Errorf("invalid command frame %q", frame)
+	}
+	t.frame = string(frame[:len(frame)-1])
+	return nil
+}
+
+// ReadReply sends the last command written to the remote sensor and returns
+// its reply.
+func (t *Transport) ReadReply() (string, error) {
+	if t.frame == "" {
+		return "", fmt.Errorf("no command to read reply for")
+	}
+	body, err := json.Marshal(Command{Command: t.frame[:2], Params: t.frame[2:]})
+	if err != nil {
+		return "", err
+	}
+	t.frame = ""
+
+	t.mu.Lock()
+	deadline := t.deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	t.cancel = cancel
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.cancel = nil
+		t.mu.Unlock()
+		cancel()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url+"/command", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", kd6rmx.ErrTimeout
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var reply Reply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("invalid reply from %s: %v", t.url, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return reply.Reply, nil
+	case http.StatusGatewayTimeout:
+		return "", kd6rmx.ErrTimeout
+	default:
+		return "", fmt.Errorf("%s: %s", t.url, reply.Error)
+	}
+}
+
+// SetReadDeadline sets the deadline for ReadReply. A deadline in the past
+// cancels a ReadReply in progress.
+func (t *Transport) SetReadDeadline(deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deadline = deadline
+	if t.cancel != nil && !deadline.IsZero() && !deadline.After(time.Now()) {
+		t.cancel()
+	}
+	return nil
+}
+
+// Close does nothing, since the remote sensor stays connected to the Handler.
+func (t *Transport) Close() error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package kd6rmx
+
+import (
+	"strconv"
+)
+
+// readBackLengths are the lengths of replies to read-back commands that
+// return more than a single register byte.
+var readBackLengths = map[string]int{
+	"LCA0": 8,
+	"LCC0": 8,
+	"LCE0": 8,
+	"PGA0": 8,
+	"SSA0": 8,
+	"WCC0": 8,
+	"SIC0": 14,
+}
+
+// checkReply returns a *ProtocolError wrapping ErrReplyMismatch if a
+// successful reply does not belong to the command that was sent.
+//
+// Replies to read-back commands (params 80, A0, C0 or E0) must have the
+// expected length, and echo the sub-register that was read. Replies to all
+// other commands must echo the params exactly.
+func checkReply(cmd, params, reply string) error {
+	frame := cmd + params
+	if len(frame) < 2 {
+		return nil
+	}
+	register, params := frame[:2], frame[2:]
+
+	ok := reply[2:] == params
+	if isReadBack(params) {
+		want, found := readBackLengths[frame]
+		if !found {
+			want = 4
+		}
+		ok = len(reply) == want && echoesSubRegister(params, reply)
+	}
+	if !ok {
+		return &ProtocolError{Command: register, Params: params, Reply: reply, Err: ErrReplyMismatch}
+	}
+	return nil
+}
+
+// isReadBack returns whether params are those of a read-back command.
+func isReadBack(params string) bool {
+	switch params {
+	case "80", "A0", "C0", "E0":
+		return true
+	}
+	return false
+}
+
+// echoesSubRegister returns whether the first register byte of the reply
+// has the same sub-register bits as the read-back params, for example 20-3F
+// in reply to A0.
+func echoesSubRegister(params, reply string) bool {
+	p, err := strconv.ParseUint(params, 16, 8)
+	if err != nil || len(reply) < 4 {
+		return false
+	}
+	r, err := strconv.ParseUint(reply[2:4], 16, 8)
+	if err != nil {
+		return false
+	}
+	return r&0xE0 == p&0x60
+}
@@ -0,0 +1,102 @@
+package kd6rmx
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Parity is the parity of a serial line.
+type Parity int
+
+const (
+	ParityNone Parity = iota
+	ParityOdd
+	ParityEven
+)
+
+// FlowControl is the flow control of a serial line.
+type FlowControl int
+
+const (
+	FlowControlNone FlowControl = iota
+	FlowControlHardware
+	FlowControlSoftware
+)
+
+// SerialConfig is the host side configuration of a serial line to a sensor.
+// The data bits are always 8.
+type SerialConfig struct {
+	BaudRate    int
+	Parity      Parity
+	StopBits    int
+	FlowControl FlowControl
+}
+
+// DefaultSerialConfig is the configuration of a sensor with factory default
+// settings: 9600 baud, 8 data bits, no parity, 1 stop bit (8N1), and no
+// flow control.
+var DefaultSerialConfig = SerialConfig{
+	BaudRate: 9600,
+	Parity:   ParityNone,
+	StopBits: 1,
+}
+
+// BaudRateSetter is implemented by transports that configure the host side
+// of a serial line. CommunicationSpeed uses it to switch the host to the new
+// speed once the sensor has accepted it.
+type BaudRateSetter interface {
+	SetBaudRate(baud int) error
+}
+
+// parseSerialConfig parses the query of a serial:// port, for example
+// baud=115200&parity=even&stopbits=1&flow=hardware. Missing values are
+// taken from DefaultSerialConfig.
+func parseSerialConfig(query url.Values) (SerialConfig, error) {
+	c := DefaultSerialConfig
+	for key, values := range query {
+		val := values[len(values)-1]
+		switch key {
+		case "baud":
+			baud, err := strconv.Atoi(val)
+			if err != nil {
+				return c, fmt.Errorf("invalid baud rate %q", val)
+			}
+			c.BaudRate = baud
+		case "parity":
+			switch val {
+			case "none":
+				c.Parity = ParityNone
+			case "odd":
+				c.Parity = ParityOdd
+			case "even":
+				c.Parity = ParityEven
+			default:
+				return c, fmt.Errorf("invalid parity %q, must be none, odd or even", val)
+			}
+		case "stopbits":
+			switch val {
+			case "1":
+				c.StopBits = 1
+			case "2":
+				c.StopBits = 2
+			default:
+				return c, fmt.Errorf("invalid stop bits %q, must be 1 or 2", val)
+			}
+		case "flow":
+			switch val {
+			case "none":
+				c.FlowControl = FlowControlNone
+			case "hardware":
+				c.FlowControl = FlowControlHardware
+			case "software":
+				c.FlowControl = FlowControlSoftware
+			default:
+				return c, fmt.Errorf("invalid flow control %q, must be none, hardware or software", val)
+			}
+		default:
+			return c, fmt.Errorf("unknown serial port option %q", key)
+		}
+	}
+	return c, nil
+}
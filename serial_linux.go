@@ -0,0 +1,123 @@
+package kd6rmx
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	115200: unix.B115200,
+}
+
+// SerialTransport is a Transport over a serial port that is configured by
+// the host, such as a USB-RS232 adapter on /dev/ttyUSB0. The port is put in
+// raw mode with 8 data bits.
+type SerialTransport struct {
+	*FileTransport
+	config SerialConfig
+}
+
+// OpenSerial opens and configures the serial port at port.
+func OpenSerial(port string, config SerialConfig) (*SerialTransport, error) {
+	f, err := os.OpenFile(port, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening control port: %v", err)
+	}
+
+	t := &SerialTransport{FileTransport: &FileTransport{f: f}}
+	if err := t.Configure(config); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Config returns the current configuration of the serial port.
+func (t *SerialTransport) Config() SerialConfig {
+	return t.config
+}
+
+// Configure changes the configuration of the serial port.
+func (t *SerialTransport) Configure(config SerialConfig) error {
+	speed, ok := baudRates[config.BaudRate]
+	if !ok {
+		return fmt.Errorf("invalid baud rate %d", config.BaudRate)
+	}
+
+	err := t.control(func(fd int) error {
+		tio, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+
+		// raw mode, see cfmakeraw(3)
+		tio.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.INPCK
+		tio.Oflag &^= unix.OPOST
+		tio.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		tio.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+		tio.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+		tio.Ispeed = speed
+		tio.Ospeed = speed
+		tio.Cc[unix.VMIN] = 1
+		tio.Cc[unix.VTIME] = 0
+
+		switch config.Parity {
+		case ParityOdd:
+			tio.Cflag |= unix.PARENB | unix.PARODD
+			tio.Iflag |= unix.INPCK
+		case ParityEven:
+			tio.Cflag |= unix.PARENB
+			tio.Iflag |= unix.INPCK
+		}
+		if config.StopBits == 2 {
+			tio.Cflag |= unix.CSTOPB
+		}
+		switch config.FlowControl {
+		case FlowControlHardware:
+			tio.Cflag |= unix.CRTSCTS
+		case FlowControlSoftware:
+			tio.Iflag |= unix.IXON | unix.IXOFF
+		}
+
+		return unix.IoctlSetTermios(fd, unix.TCSETS, tio)
+	})
+	if err != nil {
+		return fmt.Errorf("error configuring serial port: %v", err)
+	}
+
+	t.config = config
+	return nil
+}
+
+// SetBaudRate changes the baud rate of the serial port, keeping the rest of
+// its configuration.
+func (t *SerialTransport) SetBaudRate(baud int) error {
+	config := t.config
+	config.BaudRate = baud
+	return t.Configure(config)
+}
+
+// Drain discards any input received by the serial port but not yet read.
+func (t *SerialTransport) Drain() error {
+	return t.control(func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIFLUSH)
+	})
+}
+
+// control calls fn with the file descriptor of the serial port.
+func (t *SerialTransport) control(fn func(fd int) error) error {
+	rc, err := t.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package kd6rmx
+
+import (
+	"errors"
+)
+
+// SerialTransport is a Transport over a serial port that is configured by
+// the host. It is only supported on Linux.
+type SerialTransport struct {
+	*FileTransport
+	config SerialConfig
+}
+
+// OpenSerial opens and configures the serial port at port. It is only
+// supported on Linux.
+func OpenSerial(port string, config SerialConfig) (*SerialTransport, error) {
+	return nil, errors.New("serial ports are only supported on linux")
+}
+
+// Config returns the current configuration of the serial port.
+func (t *SerialTransport) Config() SerialConfig {
+	return t.config
+}
+
+// Configure changes the configuration of the serial port.
+func (t *SerialTransport) Configure(config SerialConfig) error {
+	return errors.New("serial ports are only supported on linux")
+}
+
+// SetBaudRate changes the baud rate of the serial port.
+func (t *SerialTransport) SetBaudRate(baud int) error {
+	return errors.New("serial ports are only supported on linux")
+}
@@ -0,0 +1,242 @@
+package kd6rmx
+
+// Settings is a snapshot of every configurable register of the sensor.
+//
+// Settings can be stored in JSON, YAML or TOML files, see ReadSettingsFile
+// and WriteSettingsFile.
+type Settings struct {
+	CommunicationSpeed    int             `json:"communication_speed" yaml:"communication_speed" toml:"communication_speed"`
+	OutputFrequency       float32         `json:"output_frequency" yaml:"output_frequency" toml:"output_frequency"`
+	OutputFormat          OutputFormat    `json:"output_format" yaml:"output_format" toml:"output_format"`
+	PixelOverlap          bool            `json:"pixel_overlap" yaml:"pixel_overlap" toml:"pixel_overlap"`
+	PixelInterpolation    bool            `json:"pixel_interpolation" yaml:"pixel_interpolation" toml:"pixel_interpolation"`
+	PixelResolution       int             `json:"pixel_resolution" yaml:"pixel_resolution" toml:"pixel_resolution"`
+	ExternalSync          bool            `json:"external_sync" yaml:"external_sync" toml:"external_sync"`
+	InternalSyncClock     int             `json:"internal_sync_clock" yaml:"internal_sync_clock" toml:"internal_sync_clock"`
+	LEDs                  string          `json:"leds" yaml:"leds" toml:"leds"`
+	LEDPulseDivider       int             `json:"led_pulse_divider" yaml:"led_pulse_divider" toml:"led_pulse_divider"`
+	LEDDutyA              int             `json:"led_duty_a" yaml:"led_duty_a" toml:"led_duty_a"`
+	LEDDutyB              int             `json:"led_duty_b" yaml:"led_duty_b" toml:"led_duty_b"`
+	LEDIlluminationPeriod int             `json:"led_illumination_period" yaml:"led_illumination_period" toml:"led_illumination_period"`
+	DarkCorrection        bool            `json:"dark_correction" yaml:"dark_correction" toml:"dark_correction"`
+	WhiteCorrection       bool            `json:"white_correction" yaml:"white_correction" toml:"white_correction"`
+	WhiteCorrectionTarget int             `json:"white_correction_target" yaml:"white_correction_target" toml:"white_correction_target"`
+	GainAmplifierEnabled  bool            `json:"gain_amplifier_enabled" yaml:"gain_amplifier_enabled" toml:"gain_amplifier_enabled"`
+	GainAmplifierLevel    int             `json:"gain_amplifier_level" yaml:"gain_amplifier_level" toml:"gain_amplifier_level"`
+	TestPatternEnabled    bool            `json:"test_pattern_enabled" yaml:"test_pattern_enabled" toml:"test_pattern_enabled"`
+	TestPattern           TestPatternType `json:"test_pattern" yaml:"test_pattern" toml:"test_pattern"`
+}
+
+// ReadSettings reads back every configurable register of the sensor.
+func (cis Sensor) ReadSettings() (Settings, error) {
+	var s Settings
+	var err error
+
+	if s.CommunicationSpeed, err = cis.ReadCommunicationSpeed(); err != nil {
+		return s, err
+	}
+	if s.OutputFrequency, err = cis.ReadOutputFrequency(); err != nil {
+		return s, err
+	}
+	if s.OutputFormat, err = cis.ReadPixelOutputFormat(); err != nil {
+		return s, err
+	}
+	if s.PixelOverlap, err = cis.ReadPixelOverlap(); err != nil {
+		return s, err
+	}
+	if s.PixelInterpolation, err = cis.ReadPixelInterpolation(); err != nil {
+		return s, err
+	}
+	if s.PixelResolution, err = cis.ReadPixelResolution(); err != nil {
+		return s, err
+	}
+	if s.ExternalSync, s.InternalSyncClock, err = cis.ReadSync(); err != nil {
+		return s, err
+	}
+	if s.LEDs, s.LEDPulseDivider, err = cis.ReadLEDControl(); err != nil {
+		return s, err
+	}
+	if s.LEDDutyA, err = cis.ReadLEDDutyCycle("A"); err != nil {
+		return s, err
+	}
+	if s.LEDDutyB, err = cis.ReadLEDDutyCycle("B"); err != nil {
+		return s, err
+	}
+	if s.LEDIlluminationPeriod, err = cis.ReadLEDIlluminationPeriod(); err != nil {
+		return s, err
+	}
+	if s.DarkCorrection, err = cis.ReadDarkCorrectionEnabled(); err != nil {
+		return s, err
+	}
+	if s.WhiteCorrection, err = cis.ReadWhiteCorrectionEnabled(); err != nil {
+		return s, err
+	}
+	if s.WhiteCorrectionTarget, err = cis.ReadWhiteCorrectionTarget(); err != nil {
+		return s, err
+	}
+	if s.GainAmplifierEnabled, s.GainAmplifierLevel, err = cis.ReadGainAmplifier(); err != nil {
+		return s, err
+	}
+	if s.TestPatternEnabled, err = cis.ReadTestPatternEnabled(); err != nil {
+		return s, err
+	}
+	if s.TestPattern, err = cis.ReadTestPattern(); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// ApplySettings writes every configurable register of the sensor.
+//
+// The communication speed is changed last, since the sensor stops answering
+// at the old speed as soon as it is changed. LED duty cycles of 0 are left
+// as they are.
+//
+// The white correction target is not written, since setting it makes the
+// sensor perform a white correction with whatever is in front of it, which
+// replaces its correction data. Use WhiteCorrectionTarget or Calibrate to
+// change it.
+func (cis Sensor) ApplySettings(s Settings) error {
+	return cis.applySettings(s, nil)
+}
+
+// UpdateSettings reads the current settings of the sensor, and only writes
+// the registers for fields that differ from the desired settings. It returns
+// the changes that were applied, which never include the white correction
+// target, see ApplySettings.
+func (cis Sensor) UpdateSettings(desired Settings) ([]SettingChange, error) {
+	changes, err := cis.Diff(desired)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	var applied []SettingChange
+	changed := make(map[string]bool)
+	for _, c := range changes {
+		if !appliesField(c.Field) {
+			continue
+		}
+		applied = append(applied, c)
+		changed[c.Field] = true
+	}
+	if len(applied) == 0 {
+		return nil, nil
+	}
+	return applied, cis.applySettings(desired, changed)
+}
+
+// applySettings writes the registers for the settings in the order of
+// settingSteps. If changed is not nil, only steps for fields that are
+// in changed are applied.
+func (cis Sensor) applySettings(s Settings, changed map[string]bool) error {
+	for _, step := range settingSteps {
+		if changed != nil && !step.changed(changed) {
+			continue
+		}
+		if err := step.apply(cis, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settingStep writes the registers for one or more fields of Settings.
+type settingStep struct {
+	fields []string
+	apply  func(cis Sensor, s Settings) error
+}
+
+// appliesField reports whether one of settingSteps writes the field.
+func appliesField(field string) bool {
+	for _, step := range settingSteps {
+		for _, f := range step.fields {
+			if f == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (step settingStep) changed(changed map[string]bool) bool {
+	for _, f := range step.fields {
+		if changed[f] {
+			return true
+		}
+	}
+	return false
+}
+
+var settingSteps = []settingStep{
+	{[]string{"OutputFormat"}, func(cis Sensor, s Settings) error {
+		f := s.OutputFormat
+		return cis.PixelOutputFormat(f.Bits, f.Interface, f.Config, f.Number)
+	}},
+	{[]string{"PixelOverlap"}, func(cis Sensor, s Settings) error {
+		return cis.PixelOverlap(s.PixelOverlap)
+	}},
+	{[]string{"PixelInterpolation"}, func(cis Sensor, s Settings) error {
+		return cis.PixelInterpolation(s.PixelInterpolation)
+	}},
+	{[]string{"PixelResolution"}, func(cis Sensor, s Settings) error {
+		return cis.PixelResolution(s.PixelResolution)
+	}},
+	{[]string{"OutputFrequency"}, func(cis Sensor, s Settings) error {
+		return cis.OutputFrequency(s.OutputFrequency)
+	}},
+	{[]string{"ExternalSync", "InternalSyncClock"}, func(cis Sensor, s Settings) error {
+		if s.ExternalSync {
+			return cis.ExternalSync()
+		}
+		return cis.InternalSync(s.InternalSyncClock)
+	}},
+	{[]string{"LEDs", "LEDPulseDivider"}, func(cis Sensor, s Settings) error {
+		if s.LEDs == "" {
+			return cis.LEDControl("AB", false, s.LEDPulseDivider)
+		}
+		return cis.LEDControl(s.LEDs, true, s.LEDPulseDivider)
+	}},
+	{[]string{"LEDDutyA"}, func(cis Sensor, s Settings) error {
+		return cis.applyLEDDutyCycle("A", s.LEDDutyA)
+	}},
+	{[]string{"LEDDutyB"}, func(cis Sensor, s Settings) error {
+		return cis.applyLEDDutyCycle("B", s.LEDDutyB)
+	}},
+	{[]string{"LEDIlluminationPeriod"}, func(cis Sensor, s Settings) error {
+		return cis.LEDIlluminationPeriod(s.LEDIlluminationPeriod)
+	}},
+	{[]string{"TestPattern"}, func(cis Sensor, s Settings) error {
+		return cis.TestPattern(s.TestPattern)
+	}},
+	{[]string{"TestPatternEnabled"}, func(cis Sensor, s Settings) error {
+		return cis.TestPatternEnabled(s.TestPatternEnabled)
+	}},
+	{[]string{"GainAmplifierLevel"}, func(cis Sensor, s Settings) error {
+		return cis.GainAmplifierLevel(s.GainAmplifierLevel)
+	}},
+	{[]string{"GainAmplifierEnabled"}, func(cis Sensor, s Settings) error {
+		return cis.GainAmplifierEnabled(s.GainAmplifierEnabled)
+	}},
+	{[]string{"DarkCorrection"}, func(cis Sensor, s Settings) error {
+		return cis.DarkCorrectionEnabled(s.DarkCorrection)
+	}},
+	{[]string{"WhiteCorrection"}, func(cis Sensor, s Settings) error {
+		return cis.WhiteCorrectionEnabled(s.WhiteCorrection)
+	}},
+	{[]string{"CommunicationSpeed"}, func(cis Sensor, s Settings) error {
+		return cis.CommunicationSpeed(s.CommunicationSpeed)
+	}},
+}
+
+// applyLEDDutyCycle sets the duty cycle of the LED, unless duty is 0. A
+// sensor can read back a duty of 0, but it cannot be set with LEDDutyCycle,
+// so settings read from such a sensor are applied without it.
+func (cis Sensor) applyLEDDutyCycle(led string, duty int) error {
+	if duty == 0 {
+		return nil
+	}
+	return cis.LEDDutyCycle(led, duty)
+}
@@ -0,0 +1,184 @@
+package kd6rmx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadSettingsFile decodes the settings file at path into s. The format of
+// the file is chosen by its extension, which must be .json, .yaml, .yml or
+// .toml.
+//
+// Only fields that are present in the file are changed in s, so a file can
+// describe just the settings it cares about on top of, for example, the
+// result of ReadSettings. Unknown fields are an error.
+func ReadSettingsFile(path string, s *Settings) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return DecodeSettings(data, filepath.Ext(path), s)
+}
+
+// WriteSettingsFile encodes s into the settings file at path. The format of
+// the file is chosen by its extension, as for ReadSettingsFile.
+func WriteSettingsFile(path string, s Settings) error {
+	data, err := EncodeSettings(s, filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// DecodeSettings decodes data in the given format into s. Valid formats
+// are "json", "yaml", "yml" and "toml", with or without a leading dot.
+func DecodeSettings(data []byte, format string, s *Settings) error {
+	return decode(data, format, s)
+}
+
+// EncodeSettings encodes s in the given format, as for DecodeSettings.
+func EncodeSettings(s Settings, format string) ([]byte, error) {
+	return encode(s, format)
+}
+
+// decode decodes data in the given format into v, which must be a pointer.
+// Unknown fields are an error.
+func decode(data []byte, format string, v interface{}) error {
+	switch strings.TrimPrefix(format, ".") {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(v)
+	case "yaml", "yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		return dec.Decode(v)
+	case "toml":
+		md, err := toml.Decode(string(data), v)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown settings field %q", undecoded[0].String())
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown settings format %q", format)
+	}
+}
+
+// encode encodes v in the given format, as for decode.
+func encode(v interface{}, format string) ([]byte, error) {
+	switch strings.TrimPrefix(format, ".") {
+	case "json":
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case "yaml", "yml":
+		return yaml.Marshal(v)
+	case "toml":
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown settings format %q", format)
+	}
+}
+
+// MarshalText encodes the output format the same way as the arguments to
+// the kd6ctl format command, for example "10 serial medium 2".
+func (f OutputFormat) MarshalText() ([]byte, error) {
+	bits := "10"
+	if f.Bits == PixelOutputBits8 {
+		bits = "8"
+	}
+	intf := "serial"
+	if f.Interface == PixelOutputParallel {
+		intf = "parallel"
+	}
+	conf := "base"
+	if f.Config == PixelOutputMedium {
+		conf = "medium"
+	}
+	return []byte(fmt.Sprintf("%s %s %s %d", bits, intf, conf, f.Number)), nil
+}
+
+// UnmarshalText decodes an output format encoded by MarshalText.
+func (f *OutputFormat) UnmarshalText(text []byte) error {
+	fields := strings.Fields(string(text))
+	if len(fields) != 4 {
+		return fmt.Errorf("invalid output format %q, must be <bits> <interface> <config> <num>", text)
+	}
+
+	switch fields[0] {
+	case "10":
+		f.Bits = PixelOutputBits10
+	case "8":
+		f.Bits = PixelOutputBits8
+	default:
+		return errors.New("invalid number of bits")
+	}
+
+	switch fields[1] {
+	case "serial":
+		f.Interface = PixelOutputSerial
+	case "parallel":
+		f.Interface = PixelOutputParallel
+	default:
+		return errors.New("invalid interface, must be serial or parallel")
+	}
+
+	switch fields[2] {
+	case "base":
+		f.Config = PixelOutputBase
+	case "medium":
+		f.Config = PixelOutputMedium
+	default:
+		return errors.New("invalid config, must be base or medium")
+	}
+
+	num, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return err
+	}
+	f.Number = num
+	return nil
+}
+
+// MarshalText encodes the test pattern as "stripe" or "ramp".
+func (p TestPatternType) MarshalText() ([]byte, error) {
+	switch p {
+	case TestPatternStripe:
+		return []byte("stripe"), nil
+	case TestPatternRamp:
+		return []byte("ramp"), nil
+	default:
+		return nil, fmt.Errorf("invalid test pattern %d", int(p))
+	}
+}
+
+// UnmarshalText decodes a test pattern encoded by MarshalText.
+func (p *TestPatternType) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "stripe":
+		*p = TestPatternStripe
+	case "ramp":
+		*p = TestPatternRamp
+	default:
+		return fmt.Errorf("invalid test pattern %q, must be stripe or ramp", text)
+	}
+	return nil
+}
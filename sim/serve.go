@@ -0,0 +1,34 @@
+package sim
+
+import (
+	"bufio"
+	"io"
+)
+
+// Serve reads '\r'-terminated command frames from rw and writes the sensor's
+// replies back to it, until reading from rw fails. Line feeds between frames
+// are ignored. Serve returns nil if rw reaches io.EOF.
+func (s *Sensor) Serve(rw io.ReadWriter) error {
+	r := bufio.NewReader(rw)
+	for {
+		frame, err := r.ReadString('\r')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		frame = frame[:len(frame)-1]
+		for len(frame) > 0 && frame[0] == '\n' {
+			frame = frame[1:]
+		}
+		if frame == "" {
+			continue
+		}
+
+		if _, err := io.WriteString(rw, s.Handle(frame)+"\r"); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,524 @@
+// Package sim implements an in-process simulator of a KD-MX series contact
+// image sensor.
+//
+// The simulator speaks the same ASCII protocol as the real sensor: a command
+// frame is a two letter register mnemonic followed by hex encoded params,
+// and every reply starts with a two digit status code. Successful commands
+// echo their params after the status, and read-back commands (params 80, A0,
+// C0 or E0) reply with the current register contents.
+//
+// It is meant for testing code built on top of the kd6rmx package without
+// having a sensor attached:
+//
+//	s := sim.New()
+//	cis := kd6rmx.Sensor{Transport: s.Transport()}
+//	cis.PixelResolution(300)
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status codes sent as the first two characters of every reply.
+const (
+	StatusOK               = "00"
+	StatusInvalidCommand   = "01"
+	StatusInvalidParameter = "02"
+	StatusBusy             = "03"
+	StatusChecksum         = "04"
+)
+
+// Registers holds the raw register contents of a simulated sensor.
+type Registers struct {
+	BaudRate        int // BR
+	OutputFrequency int // OF
+	OutputFormat    int // OC
+	Overlap         bool
+	Interpolation   bool
+	Resolution      int // RC
+	ExternalSync    bool
+	SyncClock       int  // SS
+	LEDControl      int  // LC
+	LEDDutyA        int  // LC 20
+	LEDDutyB        int  // LC 40
+	LEDPeriod       int  // LC 60
+	DarkCorrection  bool // DC
+	WhiteCorrection bool // WC
+	WhiteTarget     int  // WC 40
+	GainEnabled     bool // PG
+	GainNegative    bool
+	GainLevel       int
+	TestPattern     bool // TP
+	TestPatternRamp bool
+}
+
+// FactoryDefaults are the register contents of a sensor as it leaves the factory.
+var FactoryDefaults = Registers{
+	BaudRate:        0x00,
+	OutputFrequency: 0x0D,
+	OutputFormat:    0x00,
+	Resolution:      0x00,
+	SyncClock:       0x0FA0,
+	LEDControl:      0x03,
+	LEDDutyA:        0x0800,
+	LEDDutyB:        0x0800,
+	LEDPeriod:       0x0FFF,
+	DarkCorrection:  true,
+	WhiteCorrection: true,
+	WhiteTarget:     250 * 16,
+}
+
+// Sensor is a simulated KD-MX sensor. It is safe for concurrent use.
+type Sensor struct {
+	// ProductNumber, SerialID, Month and Year are reported by the SI register.
+	ProductNumber int
+	SerialID      int
+	Month         int
+	Year          int
+
+	// ResetTime is how long the sensor stays busy after a software reset.
+	ResetTime time.Duration
+
+	// CorrectionTime is how long the sensor stays busy after starting a dark
+	// or white correction.
+	CorrectionTime time.Duration
+
+	mu               sync.Mutex
+	active           Registers
+	presets          [4]Registers
+	busyUntil        time.Time
+	commands         []string
+	darkCorrections  int
+	whiteCorrections int
+}
+
+// New returns a simulated sensor with factory default settings in both its
+// active registers and all user presets.
+func New() *Sensor {
+	s := &Sensor{
+		ProductNumber: 0x6201,
+		SerialID:      0x01,
+		Month:         0x01,
+		Year:          0x22,
+		active:        FactoryDefaults,
+	}
+	for i := range s.presets {
+		s.presets[i] = FactoryDefaults
+	}
+	return s
+}
+
+// Registers returns a copy of the active register contents.
+func (s *Sensor) Registers() Registers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// SetRegisters replaces the active register contents.
+func (s *Sensor) SetRegisters(r Registers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = r
+}
+
+// Preset returns a copy of the register contents stored in a preset,
+// where 0 is the factory preset and 1-3 are the user presets.
+func (s *Sensor) Preset(n int) Registers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.presets[n]
+}
+
+// Corrections returns how many dark and white corrections have been performed.
+func (s *Sensor) Corrections() (dark, white int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.darkCorrections, s.whiteCorrections
+}
+
+// Commands returns every command frame the sensor has received, in order.
+func (s *Sensor) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Handle processes a single command frame, without the trailing '\r', and
+// returns the reply, also without the trailing '\r'.
+func (s *Sensor) Handle(frame string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands = append(s.commands, frame)
+	if time.Now().Before(s.busyUntil) {
+		return StatusBusy
+	}
+	if len(frame) < 2 {
+		return StatusInvalidCommand
+	}
+
+	cmd, params := frame[:2], frame[2:]
+	h, ok := handlers[cmd]
+	if !ok {
+		return StatusInvalidCommand
+	}
+	p, err := parseParams(params)
+	if err != nil {
+		return StatusInvalidParameter
+	}
+
+	reply, err := h(s, p)
+	if err != nil {
+		return StatusInvalidParameter
+	}
+	if reply == "" {
+		// setters echo their params on success
+		reply = params
+	}
+	return StatusOK + reply
+}
+
+var errParam = errors.New("invalid parameter")
+
+// parseParams decodes the hex encoded params of a command frame into bytes.
+func parseParams(params string) ([]byte, error) {
+	if len(params) == 0 || len(params)%2 != 0 {
+		return nil, errParam
+	}
+	b := make([]byte, len(params)/2)
+	for i := range b {
+		h := params[2*i : 2*i+2]
+		if strings.ToUpper(h) != h {
+			return nil, errParam
+		}
+		v, err := strconv.ParseUint(h, 16, 8)
+		if err != nil {
+			return nil, errParam
+		}
+		b[i] = byte(v)
+	}
+	return b, nil
+}
+
+// word returns the 16-bit value following the sub-register byte of p.
+func word(p []byte) (int, error) {
+	if len(p) != 3 {
+		return 0, errParam
+	}
+	return int(p[1])<<8 | int(p[2]), nil
+}
+
+func single(p []byte) error {
+	if len(p) != 1 {
+		return errParam
+	}
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "01"
+	}
+	return "00"
+}
+
+type handler func(s *Sensor, p []byte) (string, error)
+
+var handlers = map[string]handler{
+	"BR": handleBR,
+	"OF": handleOF,
+	"OC": handleOC,
+	"RC": handleRC,
+	"SS": handleSS,
+	"LC": handleLC,
+	"DC": handleDC,
+	"WC": handleWC,
+	"PG": handlePG,
+	"TP": handleTP,
+	"SR": handleSR,
+	"DT": handleDT,
+	"SI": handleSI,
+}
+
+func handleBR(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch {
+	case p[0] == 0x80:
+		return fmt.Sprintf("%02X", s.active.BaudRate), nil
+	case p[0] <= 0x02:
+		s.active.BaudRate = int(p[0])
+		return "", nil
+	}
+	return "", errParam
+}
+
+func handleOF(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch {
+	case p[0] == 0x80:
+		return fmt.Sprintf("%02X", s.active.OutputFrequency), nil
+	case p[0] <= 0x1C:
+		s.active.OutputFrequency = int(p[0])
+		return "", nil
+	}
+	return "", errParam
+}
+
+func handleOC(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch p[0] {
+	case 0x80:
+		return fmt.Sprintf("%02X", s.active.OutputFormat), nil
+	case 0xA0:
+		return fmt.Sprintf("%02X", 0x20|boolBit(s.active.Overlap)), nil
+	case 0xC0:
+		return fmt.Sprintf("%02X", 0x40|boolBit(s.active.Interpolation)), nil
+	case 0x20, 0x21:
+		s.active.Overlap = p[0] == 0x21
+		return "", nil
+	case 0x40, 0x41:
+		s.active.Interpolation = p[0] == 0x41
+		return "", nil
+	}
+	if p[0] <= 0x0F {
+		s.active.OutputFormat = int(p[0])
+		return "", nil
+	}
+	return "", errParam
+}
+
+func handleRC(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch {
+	case p[0] == 0x80:
+		return fmt.Sprintf("%02X", s.active.Resolution), nil
+	case p[0] <= 0x03:
+		s.active.Resolution = int(p[0])
+		return "", nil
+	}
+	return "", errParam
+}
+
+func handleSS(s *Sensor, p []byte) (string, error) {
+	switch {
+	case len(p) == 1 && p[0] == 0x80:
+		return onOff(s.active.ExternalSync), nil
+	case len(p) == 1 && p[0] == 0xA0:
+		return fmt.Sprintf("20%04X", s.active.SyncClock), nil
+	case len(p) == 1 && p[0] == 0x01:
+		s.active.ExternalSync = true
+		return "", nil
+	case len(p) == 3 && p[0] == 0x00:
+		clock, _ := word(p)
+		if clock < 1 {
+			return "", errParam
+		}
+		s.active.ExternalSync = false
+		s.active.SyncClock = clock
+		return "", nil
+	}
+	return "", errParam
+}
+
+func handleLC(s *Sensor, p []byte) (string, error) {
+	if len(p) == 1 {
+		switch {
+		case p[0] == 0x80:
+			return fmt.Sprintf("%02X", s.active.LEDControl), nil
+		case p[0] == 0xA0:
+			return fmt.Sprintf("20%04X", s.active.LEDDutyA), nil
+		case p[0] == 0xC0:
+			return fmt.Sprintf("40%04X", s.active.LEDDutyB), nil
+		case p[0] == 0xE0:
+			return fmt.Sprintf("60%04X", s.active.LEDPeriod), nil
+		case p[0] <= 0x0F:
+			s.active.LEDControl = int(p[0])
+			return "", nil
+		}
+		return "", errParam
+	}
+
+	v, err := word(p)
+	if err != nil || v > 0x0FFF {
+		return "", errParam
+	}
+	switch p[0] {
+	case 0x20:
+		s.active.LEDDutyA = v
+	case 0x40:
+		s.active.LEDDutyB = v
+	case 0x60:
+		s.active.LEDPeriod = v
+	default:
+		return "", errParam
+	}
+	return "", nil
+}
+
+func handleDC(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch p[0] {
+	case 0x80:
+		return onOff(s.active.DarkCorrection), nil
+	case 0x00, 0x01:
+		s.active.DarkCorrection = p[0] == 0x01
+		return "", nil
+	case 0x21:
+		s.darkCorrections++
+		s.busyUntil = time.Now().Add(s.CorrectionTime)
+		return "", nil
+	}
+	return "", errParam
+}
+
+func handleWC(s *Sensor, p []byte) (string, error) {
+	if len(p) == 3 {
+		v, _ := word(p)
+		if p[0] != 0x40 || v > 0x0FFF {
+			return "", errParam
+		}
+		// setting the target performs a white correction with it.
+		s.active.WhiteTarget = v
+		s.whiteCorrections++
+		s.busyUntil = time.Now().Add(s.CorrectionTime)
+		return "", nil
+	}
+
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch p[0] {
+	case 0x80:
+		return onOff(s.active.WhiteCorrection), nil
+	case 0xC0:
+		return fmt.Sprintf("40%04X", s.active.WhiteTarget), nil
+	case 0x00, 0x01:
+		s.active.WhiteCorrection = p[0] == 0x01
+		return "", nil
+	case 0x21:
+		s.whiteCorrections++
+		s.busyUntil = time.Now().Add(s.CorrectionTime)
+		return "", nil
+	}
+	return "", errParam
+}
+
+func handlePG(s *Sensor, p []byte) (string, error) {
+	if len(p) == 3 {
+		v, _ := word(p)
+		switch {
+		case p[0] == 0x20 && v <= 3071:
+			s.active.GainNegative = false
+		case p[0] == 0x21 && v <= 1027:
+			s.active.GainNegative = true
+		default:
+			return "", errParam
+		}
+		s.active.GainLevel = v
+		return "", nil
+	}
+
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch p[0] {
+	case 0x80:
+		return onOff(s.active.GainEnabled), nil
+	case 0xA0:
+		return fmt.Sprintf("%02X%04X", 0x20|boolBit(s.active.GainNegative), s.active.GainLevel), nil
+	case 0x00, 0x01:
+		s.active.GainEnabled = p[0] == 0x01
+		return "", nil
+	}
+	return "", errParam
+}
+
+func handleTP(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch p[0] {
+	case 0x80:
+		return onOff(s.active.TestPattern), nil
+	case 0xA0:
+		return fmt.Sprintf("%02X", 0x20|boolBit(s.active.TestPatternRamp)), nil
+	case 0x00, 0x01:
+		s.active.TestPattern = p[0] == 0x01
+		return "", nil
+	case 0x20, 0x21:
+		s.active.TestPatternRamp = p[0] == 0x21
+		return "", nil
+	}
+	return "", errParam
+}
+
+// handleSR performs a software reset with param 21, which reloads the
+// factory preset and keeps the sensor busy for ResetTime. Param 01
+// acknowledges that the reset has completed.
+func handleSR(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch p[0] {
+	case 0x21:
+		s.active = s.presets[0]
+		s.busyUntil = time.Now().Add(s.ResetTime)
+		return "", nil
+	case 0x01:
+		return "", nil
+	}
+	return "", errParam
+}
+
+// handleDT loads a preset into the active registers with params 00-03,
+// and saves the active registers into a user preset with params 81-83.
+func handleDT(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	switch {
+	case p[0] <= 0x03:
+		s.active = s.presets[p[0]]
+		return "", nil
+	case p[0] >= 0x81 && p[0] <= 0x83:
+		s.presets[p[0]-0x80] = s.active
+		return "", nil
+	}
+	return "", errParam
+}
+
+// handleSI replies to param C0 with the product number (low byte first),
+// serial ID, and month and year of manufacture.
+func handleSI(s *Sensor, p []byte) (string, error) {
+	if err := single(p); err != nil {
+		return "", err
+	}
+	if p[0] != 0xC0 {
+		return "", errParam
+	}
+	return fmt.Sprintf("40%02X%02X%02X%02X%02X",
+		s.ProductNumber&0xFF, s.ProductNumber>>8, s.SerialID, s.Month, s.Year), nil
+}
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
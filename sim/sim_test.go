@@ -0,0 +1,104 @@
+package sim_test
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/northvolt/go-kd6rmx"
+	"github.com/northvolt/go-kd6rmx/sim"
+)
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		frame string
+		reply string
+	}{
+		{"RC01", "0001"},
+		{"RC80", "0001"},
+		{"RC04", sim.StatusInvalidParameter},
+		{"LC200123", "00200123"},
+		{"LCA0", "00200123"},
+		{"LC20FFFF", sim.StatusInvalidParameter},
+		{"OC21", "0021"},
+		{"OCA0", "0021"},
+		{"PG210010", "00210010"},
+		{"PGA0", "00210010"},
+		{"SIC0", "00400162010122"},
+		{"XX00", sim.StatusInvalidCommand},
+		{"RC0", sim.StatusInvalidParameter},
+		{"RCzz", sim.StatusInvalidParameter},
+	}
+
+	s := sim.New()
+	for _, tt := range tests {
+		if reply := s.Handle(tt.frame); reply != tt.reply {
+			t.Errorf("%s: got reply %q, want %q", tt.frame, reply, tt.reply)
+		}
+	}
+}
+
+func TestSensorCommands(t *testing.T) {
+	s := sim.New()
+	cis := kd6rmx.Sensor{Transport: s.Transport()}
+
+	if err := cis.PixelResolution(150); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.LEDDutyCycle("b", 0x123); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.PixelResolution(1200); err == nil {
+		t.Error("expected error for invalid resolution")
+	}
+
+	r := s.Registers()
+	if r.Resolution != 0x02 {
+		t.Errorf("resolution register is %02X, want 02", r.Resolution)
+	}
+	if r.LEDDutyB != 0x123 {
+		t.Errorf("LED duty B register is %04X, want 0123", r.LEDDutyB)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	s := sim.New()
+	cis := kd6rmx.Sensor{Transport: s.Transport()}
+
+	if err := cis.PixelResolution(75); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.SaveSettings(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cis.LoadSettings(0); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.Registers(); r != sim.FactoryDefaults {
+		t.Errorf("loading preset 0 did not restore factory defaults: %+v", r)
+	}
+	if err := cis.LoadSettings(2); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.Registers(); r.Resolution != 0x03 {
+		t.Errorf("resolution register is %02X after loading preset 2, want 03", r.Resolution)
+	}
+}
+
+func TestServe(t *testing.T) {
+	s := sim.New()
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.Serve(server)
+
+	if _, err := client.Write([]byte("RC80\r")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(client).ReadString('\r')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "0000\r" {
+		t.Errorf("got reply %q, want %q", reply, "0000\r")
+	}
+}
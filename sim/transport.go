@@ -0,0 +1,59 @@
+package sim
+
+import (
+	"errors"
+	"strings"
+)
+
+// Transport connects a client directly to a simulated sensor. It implements
+// the kd6rmx.Transport interface.
+type Transport struct {
+	s       *Sensor
+	replies []string
+	closed  bool
+}
+
+// Transport returns a new Transport connected to the sensor.
+func (s *Sensor) Transport() *Transport {
+	return &Transport{s: s}
+}
+
+// WriteCommand hands every '\r'-terminated frame in frame to the sensor,
+// and queues up the replies.
+func (t *Transport) WriteCommand(frame []byte) error {
+	if t.closed {
+		return errors.New("sim: transport closed")
+	}
+	for _, f := range strings.SplitAfter(string(frame), "\r") {
+		if !strings.HasSuffix(f, "\r") {
+			continue
+		}
+		t.replies = append(t.replies, t.s.Handle(strings.TrimSuffix(f, "\r")))
+	}
+	return nil
+}
+
+// ReadReply returns the oldest queued reply.
+func (t *Transport) ReadReply() (string, error) {
+	if t.closed {
+		return "", errors.New("sim: transport closed")
+	}
+	if len(t.replies) == 0 {
+		return "", errors.New("timeout receiving result from command")
+	}
+	reply := t.replies[0]
+	t.replies = t.replies[1:]
+	return reply, nil
+}
+
+// Close closes the transport. The sensor itself keeps its state.
+func (t *Transport) Close() error {
+	t.closed = true
+	return nil
+}
+
+// Drain discards any replies that have not been read.
+func (t *Transport) Drain() error {
+	t.replies = nil
+	return nil
+}
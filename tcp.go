@@ -0,0 +1,292 @@
+package kd6rmx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dialTimeout is how long to wait for a TCP connection to be established.
+const dialTimeout = 5 * time.Second
+
+// TCPTransport is a Transport over a raw TCP connection to a serial-to-Ethernet
+// converter, which passes the bytes of the serial line through unchanged.
+type TCPTransport struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	deadline atomic.Value // time.Time
+
+	// telnet is set when the connection uses the Telnet protocol.
+	telnet bool
+}
+
+// DialTCP connects to the serial-to-Ethernet converter at addr, for example
+// "10.0.0.5:4001".
+func DialTCP(addr string) (*TCPTransport, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error opening control port: %v", err)
+	}
+	return &TCPTransport{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// WriteCommand writes the command frame to the connection.
+func (t *TCPTransport) WriteCommand(frame []byte) error {
+	if t.telnet {
+		frame = []byte(strings.Replace(string(frame), "\xff", "\xff\xff", -1))
+	}
+	if _, err := t.conn.Write(frame); err != nil {
+		return fmt.Errorf("error sending command: %v", err)
+	}
+	return nil
+}
+
+// ReadReply reads from the connection until a '\r' is received, or the read
+// deadline has passed.
+func (t *TCPTransport) ReadReply() (string, error) {
+	if d, ok := t.deadline.Load().(time.Time); !ok || d.IsZero() {
+		t.conn.SetReadDeadline(time.Now().Add(defaultTimeout))
+		defer t.conn.SetReadDeadline(time.Time{})
+	}
+
+	var result []byte
+	for {
+		b, err := t.readByte()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return "", ErrTimeout
+			}
+			return "", err
+		}
+		if b == '\r' {
+			return string(result), nil
+		}
+		result = append(result, b)
+	}
+}
+
+// SetReadDeadline sets the deadline for ReadReply.
+func (t *TCPTransport) SetReadDeadline(deadline time.Time) error {
+	t.deadline.Store(deadline)
+	return t.conn.SetReadDeadline(deadline)
+}
+
+// Drain discards any data received but not yet read.
+func (t *TCPTransport) Drain() error {
+	if err := t.conn.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+		return err
+	}
+	defer t.conn.SetReadDeadline(time.Time{})
+
+	for {
+		if _, err := t.readByte(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Close closes the connection.
+func (t *TCPTransport) Close() error {
+	return t.conn.Close()
+}
+
+// readByte returns the next byte of serial data from the connection,
+// handling any Telnet commands that come before it.
+func (t *TCPTransport) readByte() (byte, error) {
+	for {
+		b, err := t.r.ReadByte()
+		if err != nil || !t.telnet || b != telnetIAC {
+			return b, err
+		}
+
+		cmd, err := t.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch cmd {
+		case telnetIAC:
+			return telnetIAC, nil
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			opt, err := t.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if err := t.negotiate(cmd, opt); err != nil {
+				return 0, err
+			}
+		case telnetSB:
+			// the converter's replies to our settings are not needed
+			if err := t.skipSubnegotiation(); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// negotiate refuses any Telnet options the converter asks for that we have
+// not asked for ourselves.
+func (t *TCPTransport) negotiate(cmd, opt byte) error {
+	if opt == telnetBinary || opt == telnetComPort {
+		return nil
+	}
+
+	var reply byte
+	switch cmd {
+	case telnetWILL:
+		reply = telnetDONT
+	case telnetDO:
+		reply = telnetWONT
+	default:
+		return nil
+	}
+	_, err := t.conn.Write([]byte{telnetIAC, reply, opt})
+	return err
+}
+
+func (t *TCPTransport) skipSubnegotiation() error {
+	for {
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != telnetIAC {
+			continue
+		}
+		b, err = t.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == telnetSE {
+			return nil
+		}
+	}
+}
+
+// Telnet protocol bytes, see RFC 854, RFC 856 and RFC 2217.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetBinary  = 0
+	telnetComPort = 44
+
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+	comPortSetControl  = 5
+)
+
+// RFC2217Transport is a Transport over a Telnet connection to a
+// serial-to-Ethernet converter that supports the COM port control option of
+// RFC 2217, which lets the host configure the serial line.
+type RFC2217Transport struct {
+	*TCPTransport
+	config SerialConfig
+}
+
+// DialRFC2217 connects to the serial-to-Ethernet converter at addr, and
+// configures its serial line.
+func DialRFC2217(addr string, config SerialConfig) (*RFC2217Transport, error) {
+	tt, err := DialTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	tt.telnet = true
+
+	t := &RFC2217Transport{TCPTransport: tt}
+	negotiation := []byte{
+		telnetIAC, telnetWILL, telnetBinary,
+		telnetIAC, telnetDO, telnetBinary,
+		telnetIAC, telnetWILL, telnetComPort,
+	}
+	if _, err := tt.conn.Write(negotiation); err != nil {
+		tt.Close()
+		return nil, err
+	}
+	if err := t.Configure(config); err != nil {
+		tt.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Config returns the current configuration of the serial line.
+func (t *RFC2217Transport) Config() SerialConfig {
+	return t.config
+}
+
+// Configure changes the configuration of the serial line.
+func (t *RFC2217Transport) Configure(config SerialConfig) error {
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, uint32(config.BaudRate))
+
+	parity := byte(1)
+	switch config.Parity {
+	case ParityOdd:
+		parity = 2
+	case ParityEven:
+		parity = 3
+	}
+
+	stop := byte(1)
+	if config.StopBits == 2 {
+		stop = 2
+	}
+
+	control := byte(1)
+	switch config.FlowControl {
+	case FlowControlSoftware:
+		control = 2
+	case FlowControlHardware:
+		control = 3
+	}
+
+	var buf []byte
+	buf = append(buf, comPortCommand(comPortSetBaudRate, baud...)...)
+	buf = append(buf, comPortCommand(comPortSetDataSize, 8)...)
+	buf = append(buf, comPortCommand(comPortSetParity, parity)...)
+	buf = append(buf, comPortCommand(comPortSetStopSize, stop)...)
+	buf = append(buf, comPortCommand(comPortSetControl, control)...)
+	if _, err := t.conn.Write(buf); err != nil {
+		return fmt.Errorf("error configuring serial port: %v", err)
+	}
+
+	t.config = config
+	return nil
+}
+
+// SetBaudRate changes the baud rate of the serial line, keeping the rest of
+// its configuration.
+func (t *RFC2217Transport) SetBaudRate(baud int) error {
+	config := t.config
+	config.BaudRate = baud
+	return t.Configure(config)
+}
+
+// comPortCommand returns the Telnet subnegotiation for a COM port control
+// command.
+func comPortCommand(cmd byte, value ...byte) []byte {
+	buf := []byte{telnetIAC, telnetSB, telnetComPort, cmd}
+	for _, b := range value {
+		buf = append(buf, b)
+		if b == telnetIAC {
+			buf = append(buf, telnetIAC)
+		}
+	}
+	return append(buf, telnetIAC, telnetSE)
+}
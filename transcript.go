@@ -0,0 +1,171 @@
+package kd6rmx
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// TranscriptEntry is a single command and its reply in a transcript, which
+// is stored as one JSON object per line.
+type TranscriptEntry struct {
+	Time    time.Time `json:"time"`
+	Port    string    `json:"port,omitempty"`
+	Command string    `json:"command"`
+	Params  string    `json:"params"`
+	Reply   string    `json:"reply"`
+
+	// Duration is how long the exchange took, in seconds.
+	Duration float64 `json:"duration"`
+
+	// Error is the error returned for the command, if any. Timeout is set if
+	// the sensor did not reply in time.
+	Error   string `json:"error,omitempty"`
+	Timeout bool   `json:"timeout,omitempty"`
+}
+
+// TranscriptRecorder is an Observer that writes every exchange to a
+// transcript:
+//
+//	f, err := os.Create("transcript.jsonl")
+//	...
+//	rec := kd6rmx.NewTranscriptRecorder(f)
+//	cis := kd6rmx.Sensor{Port: "/dev/your-port-here", Observer: rec}
+type TranscriptRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewTranscriptRecorder returns a recorder that writes to w.
+func NewTranscriptRecorder(w io.Writer) *TranscriptRecorder {
+	return &TranscriptRecorder{enc: json.NewEncoder(w)}
+}
+
+// ObserveExchange implements Observer.
+func (r *TranscriptRecorder) ObserveExchange(e Exchange) {
+	entry := TranscriptEntry{
+		Time:     e.Start,
+		Port:     e.Port,
+		Command:  e.Command,
+		Params:   e.Params,
+		Reply:    e.Reply,
+		Duration: e.Duration.Seconds(),
+	}
+	if e.Err != nil {
+		entry.Error = e.Err.Error()
+		entry.Timeout = errors.Is(e.Err, ErrTimeout)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(entry); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Err returns the first error that occurred writing the transcript.
+func (r *TranscriptRecorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// ReadTranscript reads all entries of a transcript.
+func ReadTranscript(r io.Reader) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e TranscriptEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("transcript line %d: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// ReplayTransport is a Transport that replays the replies in a transcript,
+// for example to reproduce an issue recorded on a line without the sensor.
+// The commands written must be the same as in the transcript, in the same
+// order.
+type ReplayTransport struct {
+	entries []TranscriptEntry
+	next    int
+	pending *TranscriptEntry
+}
+
+// NewReplayTransport returns a transport that replays entries.
+func NewReplayTransport(entries []TranscriptEntry) *ReplayTransport {
+	return &ReplayTransport{entries: entries}
+}
+
+// OpenReplay returns a transport that replays the transcript file at path.
+func OpenReplay(path string) (*ReplayTransport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := ReadTranscript(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayTransport(entries), nil
+}
+
+// WriteCommand checks that frame is the next command in the transcript.
+func (t *ReplayTransport) WriteCommand(frame []byte) error {
+	if t.next >= len(t.entries) {
+		return fmt.Errorf("transcript has no more commands, got %q", frame)
+	}
+	e := &t.entries[t.next]
+	if want := e.Command + e.Params + "\r"; string(frame) != want {
+		return fmt.Errorf("transcript entry %d is %q, got %q", t.next+1, want, frame)
+	}
+	t.next++
+	t.pending = e
+	return nil
+}
+
+// ReadReply returns the recorded reply to the last command written. If the
+// sensor did not reply when the transcript was recorded, ErrTimeout is
+// returned.
+func (t *ReplayTransport) ReadReply() (string, error) {
+	e := t.pending
+	if e == nil {
+		return "", errors.New("no command to read reply for")
+	}
+	t.pending = nil
+
+	if e.Reply == "" {
+		if e.Timeout {
+			return "", ErrTimeout
+		}
+		if e.Error != "" {
+			return "", errors.New(e.Error)
+		}
+	}
+	return e.Reply, nil
+}
+
+// Remaining returns the number of commands in the transcript that have not
+// been replayed yet.
+func (t *ReplayTransport) Remaining() int {
+	return len(t.entries) - t.next
+}
+
+// Close does nothing.
+func (t *ReplayTransport) Close() error {
+	return nil
+}
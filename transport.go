@@ -0,0 +1,252 @@
+package kd6rmx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transport carries command frames to a sensor and its replies back.
+//
+// A Sensor only ever has one command outstanding on a Transport, so
+// implementations do not need to be safe for concurrent use.
+type Transport interface {
+	// WriteCommand writes a complete command frame, including the trailing '\r'.
+	WriteCommand(frame []byte) error
+
+	// ReadReply reads a single '\r'-terminated reply and returns it with the
+	// terminator removed.
+	ReadReply() (string, error)
+
+	// Close closes the transport.
+	Close() error
+}
+
+// Drainer is implemented by transports that can discard input that has been
+// received but not read, such as a late reply to a command that timed out.
+// SendCommand drains such transports before their first command, and after a
+// command got no reply, or a reply that did not belong to it.
+type Drainer interface {
+	Drain() error
+}
+
+// staleTransports are the Drainers that may have input left over, which
+// SendCommand drains before writing the next command.
+var staleTransports sync.Map
+
+// markStale makes SendCommand drain t before writing its next command, if t
+// is a Drainer.
+func markStale(t Transport) {
+	if d, ok := t.(Drainer); ok && reflect.TypeOf(d).Comparable() {
+		staleTransports.Store(d, struct{}{})
+	}
+}
+
+// drainStale drains t if it has been marked with markStale. Drainers that
+// cannot be marked are drained every time.
+func drainStale(t Transport) error {
+	d, ok := t.(Drainer)
+	if !ok {
+		return nil
+	}
+	if reflect.TypeOf(d).Comparable() {
+		if _, stale := staleTransports.LoadAndDelete(d); !stale {
+			return nil
+		}
+	}
+	return d.Drain()
+}
+
+// closeTransport closes t, and forgets that it may have been stale.
+func closeTransport(t Transport) error {
+	if reflect.TypeOf(t).Comparable() {
+		staleTransports.Delete(t)
+	}
+	return t.Close()
+}
+
+// ReadDeadliner is implemented by transports whose ReadReply can be made to
+// give up at a deadline. SendCommand sets the read deadline from the sensor's
+// Timeout and context, and uses it to interrupt reads when the context is
+// done. A zero deadline restores the transport's default behaviour.
+type ReadDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+const (
+	// defaultTimeout is how long to wait for a complete reply from the
+	// sensor, if the Sensor does not have a Timeout.
+	defaultTimeout = 10 * time.Second
+
+	// drainTimeout is how long to wait for more stale input when draining.
+	drainTimeout = 5 * time.Millisecond
+)
+
+// FileTransport is a Transport that talks to the sensor through a device file,
+// such as the serial port exposed by a Camera Link frame grabber driver.
+type FileTransport struct {
+	f        *os.File
+	deadline atomic.Value // time.Time
+}
+
+// OpenFileTransport opens the device file at port.
+func OpenFileTransport(port string) (*FileTransport, error) {
+	f, err := os.OpenFile(port, os.O_RDWR|os.O_APPEND, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("error opening control port: %v", err)
+	}
+	return &FileTransport{f: f}, nil
+}
+
+// WriteCommand writes the command frame to the device file.
+func (t *FileTransport) WriteCommand(frame []byte) error {
+	if _, err := t.f.Write(frame); err != nil {
+		return fmt.Errorf("error sending command: %v", err)
+	}
+	return nil
+}
+
+// ReadReply reads from the device file until a '\r' is received, or the read
+// deadline has passed.
+func (t *FileTransport) ReadReply() (string, error) {
+	start := time.Now()
+	return readReply(t.f, func() time.Time {
+		if d, ok := t.deadline.Load().(time.Time); ok && !d.IsZero() {
+			return d
+		}
+		return start.Add(defaultTimeout)
+	})
+}
+
+// SetReadDeadline sets the deadline for ReadReply. Device files that do not
+// support deadlines are polled until the deadline instead.
+func (t *FileTransport) SetReadDeadline(deadline time.Time) error {
+	t.deadline.Store(deadline)
+	if err := t.f.SetReadDeadline(deadline); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		return err
+	}
+	return nil
+}
+
+// Drain discards any input waiting to be read from the device file. Device
+// files that do not support read deadlines are not drained.
+func (t *FileTransport) Drain() error {
+	if err := t.f.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+		if errors.Is(err, os.ErrNoDeadline) {
+			return nil
+		}
+		return err
+	}
+	defer t.f.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 64)
+	for {
+		if _, err := t.f.Read(buf); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) || err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Close closes the device file.
+func (t *FileTransport) Close() error {
+	return t.f.Close()
+}
+
+// readReply reads from r until a '\r' is received, or until the deadline has
+// passed. An io.EOF from r is treated as no data being available yet.
+func readReply(r io.Reader, deadline func() time.Time) (string, error) {
+	buf := make([]byte, 5)
+	var result string
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			if err == io.EOF {
+				if time.Now().After(deadline()) {
+					return "", ErrTimeout
+				}
+				continue
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return "", ErrTimeout
+			}
+
+			// some other error
+			return "", err
+		}
+
+		result += string(buf[:n])
+		switch {
+		case n > 0 && result[len(result)-1] == '\r':
+			return strings.Replace(result, "\r", "", -1), nil
+		case n == 0:
+			return "", fmt.Errorf("no data in result from command")
+		case time.Now().After(deadline()):
+			return "", ErrTimeout
+		}
+	}
+}
+
+// readReply reads the reply from t, giving up at the sensor's Timeout or
+// when ctx is done, if t supports it.
+func (cis Sensor) readReply(ctx context.Context, t Transport) (string, error) {
+	rd, ok := t.(ReadDeadliner)
+	if !ok {
+		return t.ReadReply()
+	}
+
+	timeout := cis.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := rd.SetReadDeadline(deadline); err != nil {
+		return "", err
+	}
+
+	// interrupt the read if ctx is done before the reply arrives
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			rd.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	result, err := t.ReadReply()
+	close(stop)
+	<-stopped
+	rd.SetReadDeadline(time.Time{})
+
+	if err != nil && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return result, err
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}